@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+	accessLogOff      = "off"
+)
+
+type recordKey struct{}
+
+// requestRecord collects what the redirector did with a request, for the access log. It
+// is attached to the request once, and also carries what the handlers serving the request
+// need to know about it, so they don't each copy the request to add a context value.
+type requestRecord struct {
+	Site    string
+	Rule    string
+	Outcome string
+	Client  string
+	Arm     string
+
+	scheme string       // the scheme the client used, set by forwardedHeaders
+	site   *siteContext // the matched site, set when its route is served
+	shadow bool         // whether the request is being served by the shadow rule set
+}
+
+// recordFor returns the access log record for req, or a discarded record if the
+// request isn't being logged
+func recordFor(req *http.Request) *requestRecord {
+	if r, ok := req.Context().Value(recordKey{}).(*requestRecord); ok {
+		return r
+	}
+	return &requestRecord{}
+}
+
+// withRecord returns req with a record attached if it doesn't already have one, so the
+// record is shared by everything handling the request even when it isn't being logged
+func withRecord(req *http.Request) (*http.Request, *requestRecord) {
+	if r, ok := req.Context().Value(recordKey{}).(*requestRecord); ok {
+		return req, r
+	}
+	r := &requestRecord{}
+	return req.WithContext(context.WithValue(req.Context(), recordKey{}, r)), r
+}
+
+// accessLogger writes one line per request in Combined Log Format or as JSON
+type accessLogger struct {
+	format string
+	mu     sync.Mutex
+	out    io.Writer
+}
+
+// accessLog is replaced in main with a logger configured from the service configuration
+var accessLog *accessLogger
+
+func newAccessLogger(format string, out io.Writer) (*accessLogger, error) {
+	switch format {
+	case accessLogCombined, accessLogJSON:
+		return &accessLogger{format: format, out: out}, nil
+	case accessLogOff, "":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// middleware logs every request handled by h. A nil logger logs nothing.
+func (l *accessLogger) middleware(h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		req, record := withRecord(req)
+		record.Client = clientFor(req)
+		rec := &responseRecorder{ResponseWriter: w}
+
+		h.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		l.write(accessLogEntry{
+			Time:      start.UTC(),
+			ClientIP:  clientIP(req),
+			Method:    req.Method,
+			Host:      req.Host,
+			URI:       redaction.uri(req.URL.RequestURI()),
+			Proto:     req.Proto,
+			Scheme:    requestScheme(req),
+			Status:    rec.status,
+			Bytes:     rec.bytes,
+			Referrer:  redaction.uri(req.Referer()),
+			UserAgent: req.UserAgent(),
+			Location:  redaction.uri(rec.Header().Get("Location")),
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			Site:      record.Site,
+			Rule:      record.Rule,
+			Outcome:   record.Outcome,
+			Client:    record.Client,
+			Arm:       record.Arm,
+		})
+	})
+}
+
+// accessLogEntry is a single line of the access log
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Scheme    string    `json:"scheme"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	Site      string    `json:"site,omitempty"`
+	Rule      string    `json:"rule,omitempty"`
+	Outcome   string    `json:"outcome,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Arm       string    `json:"arm,omitempty"`
+}
+
+func (l *accessLogger) write(e accessLogEntry) {
+	var line []byte
+	if l.format == accessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.combined())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+// combined formats e in Combined Log Format, followed by the host, rule, outcome,
+// latency in milliseconds and client category
+func (e accessLogEntry) combined() string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s %s %s %s %.3f %s\n",
+		orDash(e.ClientIP),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		bytes,
+		strconv.Quote(orDash(e.Referrer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		orDash(e.Host),
+		orDash(e.Rule),
+		orDash(e.Outcome),
+		e.LatencyMS,
+		orDash(e.Client),
+	)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// rotatingFile is an append-only file that is rotated to path.1, path.2 and so on
+// once it reaches maxBytes, keeping at most backups old files
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	if f.backups > 0 {
+		for i := f.backups - 1; i > 0; i-- {
+			_ = os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+// Close closes the current file
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// newAccessLogOutput returns the file the access log is written to, or stdout if path is empty
+func newAccessLogOutput(path string, maxSizeMB, backups int) (io.WriteCloser, error) {
+	if len(strings.TrimSpace(path)) == 0 {
+		return nopCloser{os.Stdout}, nil
+	}
+	return newRotatingFile(path, int64(maxSizeMB)*1024*1024, backups)
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
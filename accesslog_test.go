@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAccessLog(t *testing.T) {
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	hc := healthcheck.New(versionInfo, time.Second*10, time.Minute)
+
+	serve := func(format, url string) string {
+		var buf bytes.Buffer
+		var err error
+		accessLog, err = newAccessLogger(format, &buf)
+		So(err, ShouldBeNil)
+		defer func() { accessLog = nil }()
+
+		router, err := newTestRouter(hc, defaultRules())
+		So(err, ShouldBeNil)
+
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("User-Agent", "curl/8.0")
+		req.Header.Set("Referer", "https://example.com/page")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		return buf.String()
+	}
+
+	Convey("Given the JSON access log format", t, func() {
+		Convey("Then a redirect is logged with its rule and outcome", func() {
+			var entry accessLogEntry
+			So(json.Unmarshal([]byte(serve(accessLogJSON, "https://neighbourhood.statistics.gov.uk/HTMLDocs/a?b=c")), &entry), ShouldBeNil)
+			So(entry.Status, ShouldEqual, redir)
+			So(entry.Host, ShouldEqual, "neighbourhood.statistics.gov.uk")
+			So(entry.URI, ShouldEqual, "/HTMLDocs/a?b=c")
+			So(entry.Site, ShouldEqual, "ness")
+			So(entry.Rule, ShouldEqual, "ness-website")
+			So(entry.Outcome, ShouldEqual, "redirect")
+			So(entry.Location, ShouldEqual, "https://www.ons.gov.uk/visualisations/nesscontent/a")
+			So(entry.UserAgent, ShouldEqual, "curl/8.0")
+			So(entry.Referrer, ShouldEqual, "https://example.com/page")
+			So(entry.Client, ShouldEqual, clientAPI)
+		})
+
+		Convey("Then a 410 is logged with its size", func() {
+			var entry accessLogEntry
+			So(json.Unmarshal([]byte(serve(accessLogJSON, "https://web.ons.gov.uk/ons/api/a")), &entry), ShouldBeNil)
+			So(entry.Status, ShouldEqual, 410)
+			So(entry.Bytes, ShouldEqual, len(apiResponse))
+			So(entry.Rule, ShouldEqual, "wda-api")
+			So(entry.Outcome, ShouldEqual, "gone")
+		})
+	})
+
+	Convey("Given the combined access log format", t, func() {
+		line := serve(accessLogCombined, "https://web.ons.gov.uk/ons/api/a")
+
+		Convey("Then the line is in Combined Log Format with extra fields", func() {
+			So(line, ShouldStartWith, "192.0.2.1 - - [")
+			So(line, ShouldContainSubstring, `] "GET /ons/api/a HTTP/1.1" 410 `)
+			So(line, ShouldContainSubstring, `"https://example.com/page" "curl/8.0" web.ons.gov.uk wda-api gone `)
+			So(line, ShouldEndWith, " api-client\n")
+			So(strings.Count(line, "\n"), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Unknown formats are rejected and off disables logging", t, func() {
+		_, err := newAccessLogger("xml", nil)
+		So(err, ShouldNotBeNil)
+		l, err := newAccessLogger(accessLogOff, nil)
+		So(err, ShouldBeNil)
+		So(l, ShouldBeNil)
+	})
+}
+
+func TestRotatingFile(t *testing.T) {
+	Convey("Given a rotating file with a small size limit", t, func() {
+		path := filepath.Join(t.TempDir(), "access.log")
+		f, err := newRotatingFile(path, 10, 2)
+		So(err, ShouldBeNil)
+		defer f.Close()
+
+		Convey("When more than the limit is written", func() {
+			for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+				_, err := f.Write([]byte(line))
+				So(err, ShouldBeNil)
+			}
+
+			Convey("Then old lines are rotated out, keeping the configured backups", func() {
+				current, _ := os.ReadFile(path)
+				backup1, _ := os.ReadFile(path + ".1")
+				backup2, _ := os.ReadFile(path + ".2")
+				So(string(current), ShouldEqual, "fourth\n")
+				So(string(backup1), ShouldEqual, "third\n")
+				So(string(backup2), ShouldEqual, "second\n")
+				_, err := os.Stat(path + ".3")
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+	})
+}
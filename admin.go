@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/gorilla/mux"
+)
+
+// getAdminRouter returns the router for the admin listener, which serves reports and, if
+// the rules are in a store, manages their versions. It must not be exposed on the public
+// hosts. The rules can only be changed if tokens are required.
+func getAdminRouter(tokens adminTokens, rules *activeRules) http.Handler {
+	router := mux.NewRouter()
+	router.HandleFunc("/reports/api-keys", apiKeysReportHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reports/referrers", referrersReportHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reports/traffic", trafficReportHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reports/shadow", shadowReportHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reports/canaries", canariesReportHandler).Methods(http.MethodGet)
+	router.HandleFunc("/reports/expiring", expiringReportHandler(rules)).Methods(http.MethodGet)
+
+	if rules != nil && rules.store != nil {
+		router.HandleFunc("/rules/versions", rulesVersionsHandler(rules)).Methods(http.MethodGet)
+		router.HandleFunc("/rules/versions/{version:[0-9]+}", rulesVersionHandler(rules)).Methods(http.MethodGet)
+		router.HandleFunc("/rules/diff", rulesDiffHandler(rules)).Methods(http.MethodGet)
+
+		push, rollback := pushRulesHandler(rules), rollbackRulesHandler(rules)
+		if len(tokens) == 0 {
+			push, rollback = rulesChangesDisabled, rulesChangesDisabled
+		}
+		router.HandleFunc("/rules/versions", push).Methods(http.MethodPost)
+		router.HandleFunc("/rules/rollback", rollback).Methods(http.MethodPost)
+	}
+
+	return requireToken(tokens, router)
+}
+
+// adminTokens are the bearer tokens accepted by the admin listener, by the name of whoever
+// holds them, which is recorded as the author of their changes to the rules
+type adminTokens map[string]string
+
+// newAdminTokens returns the named tokens, and token as the token named admin
+func newAdminTokens(token string, named map[string]string) adminTokens {
+	tokens := adminTokens{}
+	for name, t := range named {
+		if len(t) > 0 {
+			tokens[name] = t
+		}
+	}
+	if len(token) > 0 {
+		tokens["admin"] = token
+	}
+	return tokens
+}
+
+// holder returns the name of the token given, or false if it isn't one of the tokens
+func (t adminTokens) holder(given string) (string, bool) {
+	var name string
+	var ok bool
+	for n, token := range t {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			name, ok = n, true
+		}
+	}
+	return name, ok
+}
+
+type adminKey struct{}
+
+// adminName returns the name of the token a request to the admin listener was made with
+func adminName(req *http.Request) string {
+	name, _ := req.Context().Value(adminKey{}).(string)
+	return name
+}
+
+// requireToken rejects requests without one of the bearer tokens, if any are configured,
+// and records whose token it was for adminName
+func requireToken(tokens adminTokens, h http.Handler) http.Handler {
+	if len(tokens) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		name, ok := tokens.holder(given)
+		if !ok {
+			log.Warn(req.Context(), "security: rejected admin request", log.Data{"security": true, "path": req.URL.Path})
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), adminKey{}, name)))
+	})
+}
+
+// rulesChangesDisabled refuses changes to the rules from an admin listener anyone who can
+// reach it could use
+func rulesChangesDisabled(w http.ResponseWriter, req *http.Request) {
+	log.Warn(req.Context(), "security: rejected rules change without ADMIN_TOKEN", log.Data{"security": true, "path": req.URL.Path})
+	http.Error(w, "changing the rules requires ADMIN_TOKEN or ADMIN_TOKENS to be set", http.StatusUnauthorized)
+}
+
+// writeReport writes v as JSON, or header and rows as CSV if the request asks for it
+// with ?format=csv or an Accept header of text/csv
+func writeReport(w http.ResponseWriter, req *http.Request, v interface{}, header []string, rows [][]string) {
+	if req.URL.Query().Get("format") == "csv" || strings.Contains(req.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw := csv.NewWriter(w)
+		_ = cw.Write(header)
+		_ = cw.WriteAll(rows)
+		if err := cw.Error(); err != nil {
+			log.Error(req.Context(), "error writing response", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Error(req.Context(), "error writing response", err)
+	}
+}
+
+func apiKeysReportHandler(w http.ResponseWriter, req *http.Request) {
+	usage := apiKeys.report()
+
+	rows := make([][]string, 0, len(usage))
+	for _, u := range usage {
+		rows = append(rows, []string{
+			u.KeyHash,
+			strconv.FormatInt(u.Hits, 10),
+			u.FirstSeen.Format(time.RFC3339),
+			u.LastSeen.Format(time.RFC3339),
+			u.topUserAgent(),
+			u.topClient(),
+		})
+	}
+	writeReport(w, req, usage, []string{"key_hash", "hits", "first_seen", "last_seen", "top_user_agent", "top_client"}, rows)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxTrackedAPIKeys bounds memory use if callers send random keys
+	maxTrackedAPIKeys = 10000
+	// maxUserAgentsPerKey is the number of distinct user agents recorded for each key
+	maxUserAgentsPerKey = 10
+	// otherAPIKeys is the bucket hits are counted in once maxTrackedAPIKeys is reached
+	otherAPIKeys = "other"
+)
+
+// apiKeyUsage summarises the requests made with one API key to the retired WDA API
+type apiKeyUsage struct {
+	KeyHash string `json:"key_hash"`
+	tally
+	UserAgents map[string]int64 `json:"user_agents"`
+	Clients    map[string]int64 `json:"clients"`
+}
+
+// apiKeyStats counts hits to retired APIs per hashed API key
+type apiKeyStats struct {
+	hitCounts[string, apiKeyUsage, *apiKeyUsage]
+}
+
+var apiKeys = newAPIKeyStats()
+
+func newAPIKeyStats() *apiKeyStats {
+	s := &apiKeyStats{}
+	s.max = maxTrackedAPIKeys
+	s.overflow = func(string) string { return otherAPIKeys }
+	return s
+}
+
+// apiKey returns the value of the request's apikey query parameter, matched case-insensitively
+func apiKey(req *http.Request) string {
+	for name, values := range req.URL.Query() {
+		if strings.EqualFold(name, "apikey") && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// hashAPIKey returns the hash an API key is reported under. It matches the hash used when
+// the key is redacted from logs, so report entries can be found in the logs.
+func hashAPIKey(key string) string {
+	if redaction != nil {
+		return redaction.hashHex(key)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func (s *apiKeyStats) record(key, userAgent, client string, at time.Time) {
+	s.count(hashAPIKey(key), at, func(hash string) *apiKeyUsage {
+		return &apiKeyUsage{KeyHash: hash, UserAgents: map[string]int64{}, Clients: map[string]int64{}}
+	}, func(usage *apiKeyUsage) {
+		if _, ok := usage.UserAgents[userAgent]; ok || len(usage.UserAgents) < maxUserAgentsPerKey {
+			usage.UserAgents[userAgent]++
+		}
+		usage.Clients[client]++
+	})
+}
+
+// report returns the usage for every key, most hits first
+func (s *apiKeyStats) report() []apiKeyUsage {
+	usage := s.list(func(u apiKeyUsage) apiKeyUsage {
+		u.UserAgents = maps.Clone(u.UserAgents)
+		u.Clients = maps.Clone(u.Clients)
+		return u
+	})
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Hits != usage[j].Hits {
+			return usage[i].Hits > usage[j].Hits
+		}
+		return usage[i].KeyHash < usage[j].KeyHash
+	})
+	return usage
+}
+
+// topUserAgent returns the user agent seen most often with the key
+func (u apiKeyUsage) topUserAgent() string {
+	return mostHits(u.UserAgents)
+}
+
+// topClient returns the client category seen most often with the key
+func (u apiKeyUsage) topClient() string {
+	return mostHits(u.Clients)
+}
+
+func mostHits(counts map[string]int64) string {
+	var top string
+	var topHits int64
+	for name, n := range counts {
+		if n > topHits || (n == topHits && name < top) {
+			top, topHits = name, n
+		}
+	}
+	return top
+}
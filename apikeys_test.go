@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAPIKeyUsage(t *testing.T) {
+	Convey("Given requests to the retired WDA API with API keys", t, func() {
+		apiKeys = newAPIKeyStats()
+		defer func() { apiKeys = newAPIKeyStats() }()
+
+		router, err := newTestRouter(healthcheck.HealthCheck{}, defaultRules())
+		So(err, ShouldBeNil)
+
+		for _, target := range []string{
+			"http://data.ons.gov.uk/ons/api/data/dataset/QS101EW.json?apikey=alpha&context=Census",
+			"http://data.ons.gov.uk/ons/api/data/collections.xml?ApiKey=alpha",
+			"http://data.ons.gov.uk/ons/api/data/collections.xml?apikey=beta",
+			"http://data.ons.gov.uk/ons/api/data/collections.xml",
+		} {
+			req := httptest.NewRequest("GET", target, nil)
+			req.Header.Set("User-Agent", "harvester/1.0")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusGone)
+		}
+
+		Convey("Then hits are counted per hashed key, most hits first", func() {
+			usage := apiKeys.report()
+			So(usage, ShouldHaveLength, 2)
+			So(usage[0].KeyHash, ShouldEqual, hashAPIKey("alpha"))
+			So(usage[0].Hits, ShouldEqual, 2)
+			So(usage[0].topUserAgent(), ShouldEqual, "harvester/1.0")
+			So(usage[1].KeyHash, ShouldEqual, hashAPIKey("beta"))
+			So(usage[1].Hits, ShouldEqual, 1)
+		})
+
+		Convey("Then the keys themselves are not reported", func() {
+			b, _ := json.Marshal(apiKeys.report())
+			So(string(b), ShouldNotContainSubstring, "alpha")
+		})
+
+		Convey("Then the admin report is served as JSON", func() {
+			w := httptest.NewRecorder()
+			getAdminRouter(nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/reports/api-keys", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			var usage []apiKeyUsage
+			So(json.Unmarshal(w.Body.Bytes(), &usage), ShouldBeNil)
+			So(usage, ShouldHaveLength, 2)
+		})
+
+		Convey("Then the admin report is served as CSV", func() {
+			w := httptest.NewRecorder()
+			getAdminRouter(nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/reports/api-keys?format=csv", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			So(w.Header().Get("Content-Type"), ShouldStartWith, "text/csv")
+
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(rows, ShouldHaveLength, 3)
+			So(rows[0][0], ShouldEqual, "key_hash")
+			So(rows[1][1], ShouldEqual, "2")
+		})
+	})
+
+	Convey("Given more distinct keys than are tracked", t, func() {
+		stats := newAPIKeyStats()
+		at := time.Now().UTC()
+		for i := 0; i < maxTrackedAPIKeys+5; i++ {
+			stats.record("key"+strconv.Itoa(i), "", clientUnknown, at)
+		}
+
+		Convey("Then the excess hits are counted together", func() {
+			usage := stats.report()
+			So(usage, ShouldHaveLength, maxTrackedAPIKeys+1)
+			So(usage[0].KeyHash, ShouldEqual, otherAPIKeys)
+			So(usage[0].Hits, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestAdminToken(t *testing.T) {
+	Convey("Given an admin router with a token", t, func() {
+		router := getAdminRouter(adminTokens{"jo": "s3cret"}, nil)
+
+		Convey("Then requests without the token are rejected", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/reports/api-keys", nil))
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+
+		Convey("Then the holder of each configured token is known", func() {
+			tokens := newAdminTokens("s3cret", map[string]string{"sam": "t0ken", "nobody": ""})
+			So(tokens, ShouldResemble, adminTokens{"admin": "s3cret", "sam": "t0ken"})
+			name, ok := tokens.holder("t0ken")
+			So(ok, ShouldBeTrue)
+			So(name, ShouldEqual, "sam")
+			_, ok = tokens.holder("")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Then requests with the token are served", func() {
+			req := httptest.NewRequest("GET", "/reports/api-keys", nil)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, http.StatusOK)
+		})
+	})
+}
+
+func TestCommands(t *testing.T) {
+	Convey("Given the hash-key command", t, func() {
+		t.Setenv("REDACTION_KEY", "secret")
+		var stdout, stderr bytes.Buffer
+
+		Convey("Then it prints the keyed hash of the API key", func() {
+			So(runCommand([]string{"hash-key", "alpha"}, &stdout, &stderr), ShouldEqual, 0)
+			r, err := newRedactor("secret", nil, nil, false)
+			So(err, ShouldBeNil)
+			So(strings.TrimSpace(stdout.String()), ShouldEqual, r.hashHex("alpha"))
+		})
+	})
+
+	Convey("Given the report command and a running admin listener", t, func() {
+		apiKeys = newAPIKeyStats()
+		defer func() { apiKeys = newAPIKeyStats() }()
+		apiKeys.record("alpha", "harvester/1.0", clientAPI, time.Now().UTC())
+
+		srv := httptest.NewServer(getAdminRouter(nil, nil))
+		defer srv.Close()
+		var stdout, stderr bytes.Buffer
+
+		Convey("Then it writes the report as CSV", func() {
+			code := runCommand([]string{"report", "api-keys", "-addr", strings.TrimPrefix(srv.URL, "http://")}, &stdout, &stderr)
+			So(stderr.String(), ShouldBeEmpty)
+			So(code, ShouldEqual, 0)
+			So(stdout.String(), ShouldStartWith, "key_hash,hits")
+			So(stdout.String(), ShouldContainSubstring, hashAPIKey("alpha"))
+		})
+	})
+
+	Convey("Given an unknown command", t, func() {
+		var stdout, stderr bytes.Buffer
+
+		Convey("Then usage is printed and it fails", func() {
+			So(runCommand([]string{"frobnicate"}, &stdout, &stderr), ShouldEqual, 1)
+			So(stderr.String(), ShouldContainSubstring, "usage:")
+		})
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	auditLoad     = "load"
+	auditReload   = "reload"
+	auditSeed     = "seed"
+	auditUpdate   = "update"
+	auditRollback = "rollback"
+	auditImport   = "import"
+)
+
+var errNoAuditKey = errors.New("AUDIT_LOG_KEY must be set to write or verify the audit log")
+
+// auditRecord is an entry in the audit log. Each record's hash is an HMAC of its content
+// and the previous record's hash, so without the key a record can't be changed or removed,
+// or the log rewritten, without breaking the chain of every record after it.
+type auditRecord struct {
+	Seq      uint64       `json:"seq"`
+	Time     time.Time    `json:"time"`
+	Actor    string       `json:"actor"`
+	Action   string       `json:"action"`
+	Source   string       `json:"source"`
+	Version  string       `json:"version,omitempty"`
+	Changes  []ruleChange `json:"changes,omitempty"`
+	PrevHash string       `json:"prev_hash"`
+	Hash     string       `json:"hash"`
+}
+
+// computeHash returns the HMAC of the record's content and previous hash with key
+func (r auditRecord) computeHash(key []byte) string {
+	r.Hash = ""
+	b, _ := json.Marshal(r)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditHead identifies the last record written to the audit log by the rule store, which
+// keeps it so records removed from the end of the log are noticed
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// auditLog appends hash chained records to a file. The file is locked while a record is
+// appended, and the chain continued from its last record, so the service and the import
+// command can share it.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	key  []byte
+}
+
+// audit is replaced in main with the audit log from the service configuration; nil
+// disables auditing
+var audit *auditLog
+
+// newAuditLog returns an audit log appending to path, with hashes keyed by key, after
+// checking that it can be written and that its chain is intact
+func newAuditLog(path, key string) (*auditLog, error) {
+	if len(key) == 0 {
+		return nil, errNoAuditKey
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := verifyAuditLog(f, []byte(key)); err != nil {
+		return nil, fmt.Errorf("audit log %s: %w", path, err)
+	}
+	return &auditLog{path: path, key: []byte(key)}, nil
+}
+
+// record appends rec to the log, filling in its sequence number, time and hashes
+func (l *auditLog) record(rec auditRecord) error {
+	_, err := l.append(rec)
+	return err
+}
+
+// append appends rec to the log like record, returning the head of the log it is now, or
+// nil if auditing is disabled
+func (l *auditLog) append(rec auditRecord) (*auditHead, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	last, err := lastAuditRecord(f)
+	if err != nil {
+		return nil, fmt.Errorf("audit log %s: %w", l.path, err)
+	}
+	if last != nil {
+		rec.Seq, rec.PrevHash = last.Seq+1, last.Hash
+	} else {
+		rec.Seq, rec.PrevHash = 1, ""
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+	rec.Hash = rec.computeHash(l.key)
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return &auditHead{Seq: rec.Seq, Hash: rec.Hash}, nil
+}
+
+// contains checks that the log still has the record at head, which the rule store last
+// wrote, so records after it can't have been removed
+func (l *auditLog) contains(head auditHead) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Seq != head.Seq {
+			continue
+		}
+		if rec.Hash != head.Hash {
+			return fmt.Errorf("audit log %s: record %d isn't the one the rule store wrote", l.path, head.Seq)
+		}
+		return nil
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("audit log %s: record %d, which the rule store wrote, has been removed", l.path, head.Seq)
+}
+
+// lastAuditRecord returns the final record in f, reading backwards from the end, or nil
+// if f is empty
+func lastAuditRecord(f *os.File) (*auditRecord, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const chunk = 64 * 1024
+	end := info.Size()
+	var tail []byte
+	for pos := end; pos > 0; {
+		n := int64(chunk)
+		if pos < n {
+			n = pos
+		}
+		pos -= n
+		buf := make([]byte, n)
+		if _, err := f.ReadAt(buf, pos); err != nil && err != io.EOF {
+			return nil, err
+		}
+		tail = append(buf, tail...)
+		if i := bytes.LastIndexByte(bytes.TrimRight(tail, "\n"), '\n'); i >= 0 {
+			tail = tail[i+1:]
+			break
+		}
+	}
+
+	tail = bytes.TrimSpace(tail)
+	if len(tail) == 0 {
+		return nil, nil
+	}
+	var rec auditRecord
+	if err := json.Unmarshal(tail, &rec); err != nil {
+		return nil, fmt.Errorf("last record is corrupt: %w", err)
+	}
+	return &rec, nil
+}
+
+// verifyAuditLog checks that every record in r follows the one before it and has the
+// hash of its content with key, returning the number of records
+func verifyAuditLog(r io.Reader, key []byte) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	var prev auditRecord
+	var count int
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return count, fmt.Errorf("record %d is corrupt: %w", count+1, err)
+		}
+		switch {
+		case rec.Seq != prev.Seq+1:
+			return count, fmt.Errorf("record %d has sequence number %d, expected %d", count+1, rec.Seq, prev.Seq+1)
+		case rec.PrevHash != prev.Hash:
+			return count, fmt.Errorf("record %d doesn't follow record %d", rec.Seq, prev.Seq)
+		case !hmac.Equal([]byte(rec.Hash), []byte(rec.computeHash(key))):
+			return count, fmt.Errorf("record %d has been modified", rec.Seq)
+		}
+		prev = rec
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// auditCommand verifies the chain of an audit log with the key it was written with
+func auditCommand(path, key string, args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "verify" || len(args) > 2 {
+		return flag.ErrHelp
+	}
+	if len(args) == 2 {
+		path = args[1]
+	}
+	if len(path) == 0 {
+		return errors.New("an audit log must be given or set with AUDIT_LOG_FILE")
+	}
+	if len(key) == 0 {
+		return errNoAuditKey
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	count, err := verifyAuditLog(f, []byte(key))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	_, err = fmt.Fprintf(stdout, "%s: %d records verified\n", path, count)
+	return err
+}
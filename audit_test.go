@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testAuditKey = "audit-s3cret"
+
+func TestAuditLog(t *testing.T) {
+	Convey("Given an audit log written to by two processes", t, func() {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		service, err := newAuditLog(path, testAuditKey)
+		So(err, ShouldBeNil)
+		importer, err := newAuditLog(path, testAuditKey)
+		So(err, ShouldBeNil)
+
+		So(service.record(auditRecord{Actor: "system", Action: auditLoad, Source: "builtin", Version: "builtin"}), ShouldBeNil)
+		So(importer.record(auditRecord{Actor: "jo", Action: auditImport, Source: "import:a.csv",
+			Changes: []ruleChange{{Change: changeAdded, Path: "sites/visual/redirects/a", New: "https://www.ons.gov.uk/a"}}}), ShouldBeNil)
+		So(service.record(auditRecord{Actor: "system", Action: auditReload, Source: "file:rules.json"}), ShouldBeNil)
+
+		verify := func() (int, error) {
+			f, err := os.Open(path)
+			So(err, ShouldBeNil)
+			defer f.Close()
+			return verifyAuditLog(f, []byte(testAuditKey))
+		}
+		tamper := func(edit func([]string) []string) {
+			b, err := os.ReadFile(path)
+			So(err, ShouldBeNil)
+			lines := edit(strings.Split(strings.TrimSpace(string(b)), "\n"))
+			So(os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600), ShouldBeNil)
+		}
+
+		Convey("Then the records form one chain", func() {
+			count, err := verify()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 3)
+
+			var stdout bytes.Buffer
+			So(auditCommand(path, testAuditKey, []string{"verify"}, &stdout), ShouldBeNil)
+			So(stdout.String(), ShouldEqual, path+": 3 records verified\n")
+		})
+
+		Convey("Then a modified record is detected", func() {
+			tamper(func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"actor":"jo"`, `"actor":"sam"`, 1)
+				return lines
+			})
+			_, err := verify()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "record 2 has been modified")
+			So(auditCommand(path, testAuditKey, []string{"verify"}, &bytes.Buffer{}), ShouldNotBeNil)
+		})
+
+		Convey("Then a removed record is detected", func() {
+			tamper(func(lines []string) []string { return append(lines[:1], lines[2:]...) })
+			_, err := verify()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then a broken chain stops the log being opened", func() {
+			tamper(func(lines []string) []string { return []string{lines[1], lines[0], lines[2]} })
+			_, err := newAuditLog(path, testAuditKey)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Then a log rewritten without the key is detected", func() {
+			forged, err := newAuditLog(filepath.Join(t.TempDir(), "forged.log"), "guessed")
+			So(err, ShouldBeNil)
+			So(forged.record(auditRecord{Actor: "system", Action: auditLoad, Source: "builtin"}), ShouldBeNil)
+			b, err := os.ReadFile(forged.path)
+			So(err, ShouldBeNil)
+			So(os.WriteFile(path, b, 0o600), ShouldBeNil)
+			_, err = verify()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "record 1 has been modified")
+		})
+
+		Convey("Then the log can't be written or verified without a key", func() {
+			_, err := newAuditLog(path, "")
+			So(err, ShouldEqual, errNoAuditKey)
+			So(auditCommand(path, "", []string{"verify"}, &bytes.Buffer{}), ShouldEqual, errNoAuditKey)
+		})
+	})
+}
+
+func TestAuditedChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	audit, err = newAuditLog(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { audit = nil }()
+
+	records := func() []auditRecord {
+		b, err := os.ReadFile(path)
+		So(err, ShouldBeNil)
+		count, err := verifyAuditLog(bytes.NewReader(b), []byte(testAuditKey))
+		So(err, ShouldBeNil)
+
+		recs := make([]auditRecord, 0, count)
+		for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+			var rec auditRecord
+			So(json.Unmarshal([]byte(line), &rec), ShouldBeNil)
+			recs = append(recs, rec)
+		}
+		return recs
+	}
+
+	Convey("Given rules loaded from a file", t, func() {
+		rulesFile := filepath.Join(t.TempDir(), "rules.json")
+		So(os.WriteFile(rulesFile, []byte(fmt.Sprintf(testRulesJSON, "v1")), 0o600), ShouldBeNil)
+		active := newActiveRules(rulesFile)
+		So(active.reload(context.Background()), ShouldBeNil)
+		So(active.reload(context.Background()), ShouldBeNil)
+
+		Convey("When the file changes and is reloaded", func() {
+			changed := strings.Replace(fmt.Sprintf(testRulesJSON, "v2"), `"gone"`, `"landing"`, 1)
+			So(os.WriteFile(rulesFile, []byte(changed), 0o600), ShouldBeNil)
+			So(active.reload(context.Background()), ShouldBeNil)
+
+			Convey("Then the first load and the change are audited, but not the unchanged reload", func() {
+				recs := records()
+				So(recs, ShouldHaveLength, 2)
+				So(recs[0].Action, ShouldEqual, auditLoad)
+				So(recs[0].Actor, ShouldEqual, "system")
+				So(recs[0].Source, ShouldEqual, "file:"+rulesFile)
+				So(recs[0].Version, ShouldEqual, "v1")
+				So(recs[1].Action, ShouldEqual, auditReload)
+				So(recs[1].Version, ShouldEqual, "v2")
+				So(recs[1].Changes, ShouldResemble, []ruleChange{{
+					Change: changeChanged,
+					Path:   "sites/x/routes/x",
+					Old:    `{"id":"x","path":"/{uri:.*}","handler":"gone"}`,
+					New:    `{"id":"x","path":"/{uri:.*}","handler":"landing"}`,
+				}})
+			})
+		})
+
+		Convey("When the file is also loaded as shadow rules", func() {
+			shadow := newActiveRules(rulesFile)
+			shadow.candidate = true
+			So(shadow.reload(context.Background()), ShouldBeNil)
+
+			Convey("Then the load is audited as the shadow rules'", func() {
+				recs := records()
+				last := recs[len(recs)-1]
+				So(last.Action, ShouldEqual, auditLoad)
+				So(last.Source, ShouldEqual, "shadow:file:"+rulesFile)
+			})
+		})
+	})
+
+	Convey("Given rules in a store", t, func() {
+		So(os.Truncate(path, 0), ShouldBeNil)
+		store, err := openRuleStore(filepath.Join(t.TempDir(), "rules.db"))
+		So(err, ShouldBeNil)
+		defer store.Close()
+		_, err = seedRuleStore(store, "")
+		So(err, ShouldBeNil)
+		active := newActiveRules("")
+		active.store = store
+		So(active.reload(context.Background()), ShouldBeNil)
+
+		Convey("When they are changed and rolled back through the admin listener", func() {
+			admin := getAdminRouter(adminTokens{"jo": "s3cret", "sam": "t0ken"}, active)
+			post := func(token, url string, body io.Reader) int {
+				req := httptest.NewRequest("POST", url+"&author=mallory", body)
+				req.Header.Set("Authorization", "Bearer "+token)
+				w := httptest.NewRecorder()
+				admin.ServeHTTP(w, req)
+				return w.Code
+			}
+			So(post("s3cret", "/rules/versions?message=x", strings.NewReader(fmt.Sprintf(testRulesJSON, "x"))), ShouldEqual, http.StatusOK)
+			So(post("t0ken", "/rules/rollback?to=1", nil), ShouldEqual, http.StatusOK)
+
+			Convey("Then the seed, update and rollback are audited with their authors and changes", func() {
+				recs := records()
+				So(recs, ShouldHaveLength, 3)
+				So(recs[0].Action, ShouldEqual, auditSeed)
+				So(recs[1].Action, ShouldEqual, auditUpdate)
+				So(recs[1].Actor, ShouldEqual, "jo")
+				So(recs[1].Source, ShouldEqual, "api")
+				So(recs[1].Changes, ShouldContain, ruleChange{Change: changeAdded, Path: "sites/x/routes/x", New: `{"id":"x","path":"/{uri:.*}","handler":"gone"}`})
+				So(recs[2].Action, ShouldEqual, auditRollback)
+				So(recs[2].Actor, ShouldEqual, "sam")
+				So(recs[2].Version, ShouldEqual, "3")
+				So(recs[2].Changes, ShouldContain, ruleChange{Change: changeRemoved, Path: "sites/x/routes/x", Old: `{"id":"x","path":"/{uri:.*}","handler":"gone"}`})
+			})
+
+			Convey("Then records removed from the end of the log are detected by the store", func() {
+				So(store.checkAudited(audit), ShouldBeNil)
+				b, err := os.ReadFile(path)
+				So(err, ShouldBeNil)
+				lines := strings.SplitAfter(string(b), "\n")
+				So(os.WriteFile(path, []byte(lines[0]+lines[1]), 0o600), ShouldBeNil)
+				err = store.checkAudited(audit)
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldEndWith, "record 3, which the rule store wrote, has been removed")
+			})
+
+			Convey("Then changes that aren't stored aren't audited", func() {
+				So(post("s3cret", "/rules/versions?message=y&parent=1", strings.NewReader(fmt.Sprintf(testRulesJSON, "y"))), ShouldEqual, http.StatusConflict)
+				So(records(), ShouldHaveLength, 3)
+			})
+
+			Convey("Then changes that can't be audited aren't made", func() {
+				working := audit
+				defer func() { audit = working }()
+				audit = &auditLog{path: t.TempDir(), key: []byte(testAuditKey)}
+				So(post("s3cret", "/rules/versions?message=y", strings.NewReader(fmt.Sprintf(testRulesJSON, "y"))), ShouldEqual, http.StatusInternalServerError)
+				So(post("s3cret", "/rules/rollback?to=2", nil), ShouldEqual, http.StatusInternalServerError)
+				current, err := store.current()
+				So(err, ShouldBeNil)
+				So(current.Version, ShouldEqual, 3)
+				So(active.status().Version, ShouldEqual, "3")
+			})
+		})
+	})
+
+	Convey("Given rules loaded from a file and an audit log that can't be written", t, func() {
+		rulesFile := filepath.Join(t.TempDir(), "rules.json")
+		So(os.WriteFile(rulesFile, []byte(fmt.Sprintf(testRulesJSON, "v1")), 0o600), ShouldBeNil)
+		working := audit
+		defer func() { audit = working }()
+		audit = &auditLog{path: t.TempDir(), key: []byte(testAuditKey)}
+
+		Convey("Then the rules aren't loaded", func() {
+			active := newActiveRules(rulesFile)
+			So(active.reload(context.Background()), ShouldNotBeNil)
+			So(active.current(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Canary arms a request can be assigned to
+const (
+	armControl   = "control"
+	armCandidate = "candidate"
+)
+
+// canary sends a percentage of a route's requests to a new handler or destination, to
+// validate a new mapping against real traffic before switching over. Clients are
+// assigned to an arm by a hash of their address and user agent, so each client sees
+// the same destination on every request.
+type canary struct {
+	Percent     float64 `json:"percent"`
+	Handler     string  `json:"handler,omitempty"`
+	Destination string  `json:"destination,omitempty"`
+}
+
+// canaryArm returns the arm req is assigned to for the route ruleID. The route is
+// included in the hash so that different canaries pick different clients.
+func canaryArm(ruleID string, percent float64, req *http.Request) string {
+	h := fnv.New64a()
+	h.Write([]byte(ruleID + "\x00" + clientIP(req) + "\x00" + req.UserAgent()))
+	if float64(h.Sum64()%10000) < percent*100 {
+		return armCandidate
+	}
+	return armControl
+}
+
+// canaryHandler serves requests with candidate for percent of clients and control for
+// the rest, counting the outcome of each arm
+func canaryHandler(ruleID string, percent float64, control, candidate http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		record := recordFor(req)
+		record.Arm = canaryArm(ruleID, percent, req)
+		if record.Arm == armCandidate {
+			candidate(w, req)
+		} else {
+			control(w, req)
+		}
+		if !shadowing(req) {
+			canaries.record(record.Site, record.Rule, record.Arm, record.Outcome, time.Now().UTC())
+		}
+	}
+}
+
+type canaryKey struct {
+	site, rule, arm, outcome string
+}
+
+// canaryUsage counts the outcomes of one arm of a canary route
+type canaryUsage struct {
+	Site    string `json:"site"`
+	Rule    string `json:"rule"`
+	Arm     string `json:"arm"`
+	Outcome string `json:"outcome"`
+	tally
+}
+
+// canaryStats counts requests per canary route, arm and outcome
+type canaryStats struct {
+	hitCounts[canaryKey, canaryUsage, *canaryUsage]
+}
+
+var canaries = newCanaryStats()
+
+func newCanaryStats() *canaryStats {
+	return &canaryStats{}
+}
+
+func (s *canaryStats) record(site, rule, arm, outcome string, at time.Time) {
+	s.count(canaryKey{site, rule, arm, outcome}, at, func(key canaryKey) *canaryUsage {
+		return &canaryUsage{Site: key.site, Rule: key.rule, Arm: key.arm, Outcome: key.outcome}
+	}, nil)
+}
+
+// report returns the counts for every canary route, arm and outcome, ordered by route
+func (s *canaryStats) report() []canaryUsage {
+	usage := s.list(nil)
+
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i], usage[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Arm != b.Arm {
+			return a.Arm < b.Arm
+		}
+		return a.Outcome < b.Outcome
+	})
+	return usage
+}
+
+func canariesReportHandler(w http.ResponseWriter, req *http.Request) {
+	usage := canaries.report()
+
+	rows := make([][]string, 0, len(usage))
+	for _, u := range usage {
+		rows = append(rows, []string{
+			u.Site,
+			u.Rule,
+			u.Arm,
+			u.Outcome,
+			strconv.FormatInt(u.Hits, 10),
+			u.LastSeen.Format(time.RFC3339),
+		})
+	}
+	writeReport(w, req, usage, []string{"site", "rule", "arm", "outcome", "hits", "last_seen"}, rows)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCanaryRoutes(t *testing.T) {
+	Convey("Given a route sending a percentage of clients to a new destination", t, func() {
+		canaries = newCanaryStats()
+		defer func() { canaries = newCanaryStats() }()
+
+		rules := defaultRules()
+		rules.Sites[0].Routes = append([]route{{
+			ID:      "ness-remap",
+			Path:    "/HTMLDocs/remap/{uri:.*}",
+			Handler: "ness-content",
+			Canary: &canary{
+				Percent:     25,
+				Destination: `"https://www.ons.gov.uk/explore-local-statistics/" + vars.uri`,
+			},
+		}}, rules.Sites[0].Routes...)
+		router, err := newTestRouter(healthcheck.HealthCheck{}, rules)
+		So(err, ShouldBeNil)
+
+		serve := func(client int) string {
+			req := httptest.NewRequest("GET", "http://neighbourhood.statistics.gov.uk/HTMLDocs/remap/a", nil)
+			req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", client)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, redir)
+			return w.Header().Get("Location")
+		}
+
+		Convey("Then roughly that percentage of clients get the new destination", func() {
+			candidates := 0
+			for client := 0; client < 200; client++ {
+				if serve(client) == "https://www.ons.gov.uk/explore-local-statistics/a" {
+					candidates++
+				}
+			}
+			So(candidates, ShouldBeBetween, 25, 75)
+		})
+
+		Convey("Then each client always gets the same destination", func() {
+			for client := 0; client < 20; client++ {
+				So(serve(client), ShouldEqual, serve(client))
+			}
+		})
+
+		Convey("Then outcomes are counted per arm", func() {
+			for client := 0; client < 100; client++ {
+				serve(client)
+			}
+			usage := canaries.report()
+			So(usage, ShouldHaveLength, 2)
+			So(usage[0].Arm, ShouldEqual, armCandidate)
+			So(usage[1].Arm, ShouldEqual, armControl)
+			So(usage[0].Rule, ShouldEqual, "ness-remap")
+			So(usage[0].Site, ShouldEqual, "ness")
+			So(usage[0].Outcome, ShouldEqual, "redirect")
+			So(usage[0].Hits+usage[1].Hits, ShouldEqual, 100)
+
+			w := httptest.NewRecorder()
+			getAdminRouter(nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/reports/canaries?format=csv", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(rows, ShouldHaveLength, 3)
+		})
+	})
+
+	Convey("Canary percentages outside 0 to 100 and unknown handlers are rejected", t, func() {
+		for _, c := range []*canary{{Percent: 101, Handler: "landing"}, {Percent: -1, Handler: "landing"}, {Percent: 10, Handler: "nope"}} {
+			rules := defaultRules()
+			rules.Sites[0].Routes[0].Canary = c
+			So(rules.validate(), ShouldNotBeNil)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-legacy-redirector/config"
+)
+
+const usage = `usage: dp-legacy-redirector [command]
+
+With no command the redirector service is started.
+
+commands:
+  report <name> [-addr host:port] [-format json|csv] [-by domain] [-days n]
+      fetch a report from a running redirector's admin listener.
+      Reports: api-keys, referrers, traffic, canaries, shadow, expiring
+  rules list|show <version>|diff <from> [<to>]|push <rules.json>|rollback <version>
+        [-addr host:port] [-format json|csv] [-message text]
+      manage the versions of the rules in a running redirector's RULES_STORE. push stores
+      a rules file as a new version and rollback stores an old version as a new one; both
+      are served immediately and record the holder of ADMIN_TOKEN as their author
+  replay [-old rules.json] [-new rules.json] [-format auto|alb|combined|urls] [-host host]
+         [-all] [-distinct n] <log>...
+      replay requests from access logs (.gz or - for stdin) against two rule sets, either
+      defaulting to the built-in rules, and write the requests whose status or Location
+      changed as CSV. Exits with status 2 if any changed.
+  import [-rules rules.json] [-addr host:port] [-site visual] [-format auto|csv|tsv|nginx]
+         [-version v] [-key key.pem] [-overwrite] [-dry-run] <file>...
+      import slug to destination mappings from spreadsheets or nginx maps into a site's
+      redirects in a rules file, defaulting to RULES_FILE, or pushed to a running
+      redirector's store if RULES_STORE is set, and write what happened to each as CSV.
+      Signed rules must be signed again with -key. Exits with status 2 if any mappings
+      conflicted with existing ones or were invalid.
+  export [-rules rules.json] [-format nginx|apache|cloudfront]
+      render a rule set, by default the built-in rules, as nginx server blocks, Apache
+      mod_rewrite rules or a CloudFront Function
+  audit verify [file]
+      check with AUDIT_LOG_KEY that no record of an audit log, by default AUDIT_LOG_FILE,
+      has been modified, removed or reordered
+  sign -key key.pem <rules.json>
+  sign -generate -key key.pem
+      write a bundle of a rules file signed with an ed25519 private key, for RULES_FILE or
+      rules push when REQUIRE_SIGNED_RULES is set, or generate a new private key and print
+      its public key for RULES_PUBLIC_KEYS
+  hash-key <apikey>
+      print the hash an API key is reported and logged under, using REDACTION_KEY
+`
+
+// runCommand runs a command line subcommand and returns the process exit code
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	cfg, err := config.Get()
+	if err != nil {
+		fmt.Fprintln(stderr, "unable to retrieve service configuration:", err)
+		return 1
+	}
+
+	// Signed rules are verified if keys are configured, but only the service requires them
+	if ruleSigning, err = newSignaturePolicy(cfg.RulesPublicKeys, false); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "report":
+		err = reportCommand(cfg, args[1:], stdout)
+	case "rules":
+		err = rulesCommand(cfg, args[1:], stdout)
+	case "replay":
+		err = replayCommand(cfg, args[1:], stdout, stderr)
+	case "import":
+		err = importCommand(cfg, args[1:], stdout, stderr)
+	case "export":
+		err = exportCommand(args[1:], stdout, stderr)
+	case "audit":
+		err = auditCommand(cfg.AuditLogFile, cfg.AuditLogKey, args[1:], stdout)
+	case "sign":
+		err = signCommand(args[1:], stdout, stderr)
+	case "hash-key":
+		err = hashKeyCommand(cfg, args[1:], stdout)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		err = fmt.Errorf("unknown command %q", args[0])
+	}
+
+	if err == errDifferences || err == errImportProblems {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		if err == flag.ErrHelp || strings.HasPrefix(err.Error(), "unknown command") {
+			fmt.Fprint(stderr, usage)
+		}
+		return 1
+	}
+	return 0
+}
+
+func reportCommand(cfg *config.Config, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	name := args[0]
+
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	addr := fs.String("addr", cfg.AdminBindAddr, "admin listener address")
+	format := fs.String("format", "csv", "report format, json or csv")
+	by := fs.String("by", "", "group the referrers report by domain")
+	days := fs.Int("days", defaultExpiringDays, "days ahead to include in the expiring report")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	query := url.Values{"format": {*format}}
+	if len(*by) > 0 {
+		query.Set("by", *by)
+	}
+	if name == "expiring" {
+		query.Set("days", strconv.Itoa(*days))
+	}
+	return adminRequest(cfg, *addr, http.MethodGet, "/reports/"+name, query, nil, stdout)
+}
+
+// adminRequest makes a request to a running redirector's admin listener at addr and
+// copies the response body to stdout
+func adminRequest(cfg *config.Config, addr, method, path string, query url.Values, body io.Reader, stdout io.Writer) error {
+	host := addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: path, RawQuery: query.Encode()}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	if len(cfg.AdminToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cfg.AdminToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response from %s: %s %s", u.String(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	_, err = io.Copy(stdout, resp.Body)
+	return err
+}
+
+// rulesCommand lists, shows, diffs, pushes and rolls back versions of the rules in a
+// running redirector's store
+func rulesCommand(cfg *config.Config, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	action := args[0]
+
+	fs := flag.NewFlagSet("rules "+action, flag.ContinueOnError)
+	addr := fs.String("addr", cfg.AdminBindAddr, "admin listener address")
+	format := fs.String("format", "csv", "output format, json or csv")
+	message := fs.String("message", "", "why the rules are being changed")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	query := url.Values{"format": {*format}}
+
+	switch {
+	case action == "list" && fs.NArg() == 0:
+		return adminRequest(cfg, *addr, http.MethodGet, "/rules/versions", query, nil, stdout)
+	case action == "show" && fs.NArg() == 1:
+		return adminRequest(cfg, *addr, http.MethodGet, "/rules/versions/"+url.PathEscape(fs.Arg(0)), nil, nil, stdout)
+	case action == "diff" && (fs.NArg() == 1 || fs.NArg() == 2):
+		query.Set("from", fs.Arg(0))
+		if fs.NArg() == 2 {
+			query.Set("to", fs.Arg(1))
+		}
+		return adminRequest(cfg, *addr, http.MethodGet, "/rules/diff", query, nil, stdout)
+	case action == "push" && fs.NArg() == 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		query.Set("message", *message)
+		return adminRequest(cfg, *addr, http.MethodPost, "/rules/versions", query, f, stdout)
+	case action == "rollback" && fs.NArg() == 1:
+		query.Set("to", fs.Arg(0))
+		return adminRequest(cfg, *addr, http.MethodPost, "/rules/rollback", query, nil, stdout)
+	default:
+		return flag.ErrHelp
+	}
+}
+
+func hashKeyCommand(cfg *config.Config, args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return flag.ErrHelp
+	}
+	if len(cfg.RedactionKey) == 0 {
+		return fmt.Errorf("REDACTION_KEY must be set to the value used by the service")
+	}
+
+	r, err := newRedactor(cfg.RedactionKey, nil, nil, false)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(stdout, r.hashHex(args[0]))
+	return err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client categories assigned to requests by their user agent
+const (
+	clientBot     = "bot"
+	clientAPI     = "api-client"
+	clientBrowser = "browser"
+	clientUnknown = "unknown"
+	clientMonitor = "monitor"
+)
+
+var clientCategories = []string{clientBot, clientAPI, clientBrowser, clientMonitor, clientUnknown}
+
+// defaultClientPatterns classifies user agents not matched by a configured pattern.
+// Crawlers are matched before browsers, as most crawlers claim to be Mozilla.
+var defaultClientPatterns = []string{
+	clientMonitor + `=(?i)uptimerobot|pingdom|statuscake|site24x7|newrelicpinger|datadog|kube-probe|elb-healthchecker|googlestackdrivermonitoring`,
+	clientBot + `=(?i)bot\b|bot/|crawler|spider|slurp|archiver|heritrix|facebookexternalhit|embedly|bingpreview|yandex|baiduspider|duckduckgo|semrush|ahrefs|mj12|petalbot|headlesschrome|phantomjs|lighthouse`,
+	clientAPI + `=(?i)^(curl|wget|python-requests|python-urllib|python-httpx|aiohttp|go-http-client|java|apache-httpclient|okhttp|axios|node-fetch|got|undici|libwww-perl|lwp|php|guzzlehttp|ruby|faraday|rest-client|restsharp|postmanruntime|insomnia|powershell|r |httr|libcurl|excel|microsoft office|dart)`,
+	clientBrowser + `=(?i)^mozilla/|^opera/`,
+}
+
+type clientPattern struct {
+	category string
+	re       *regexp.Regexp
+}
+
+// classifier assigns a client category to user agents using an ordered list of patterns
+type classifier struct {
+	patterns []clientPattern
+}
+
+// clients is replaced in main with a classifier using the patterns from the service
+// configuration ahead of the defaults
+var clients, _ = newClassifier(nil)
+
+// newClassifier returns a classifier trying patterns, each in the form category=regexp,
+// before the default patterns
+func newClassifier(patterns []string) (*classifier, error) {
+	c := &classifier{}
+	for _, p := range append(append([]string{}, patterns...), defaultClientPatterns...) {
+		if len(strings.TrimSpace(p)) == 0 {
+			continue
+		}
+		category, expr, ok := strings.Cut(p, "=")
+		category = strings.ToLower(strings.TrimSpace(category))
+		if !ok || !isClientCategory(category) {
+			return nil, fmt.Errorf("invalid user agent pattern %q: must be one of %s followed by =regexp", p, strings.Join(clientCategories, ", "))
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent pattern %q: %w", p, err)
+		}
+		c.patterns = append(c.patterns, clientPattern{category, re})
+	}
+	return c, nil
+}
+
+func isClientCategory(category string) bool {
+	for _, c := range clientCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// classify returns the category of the first pattern matching userAgent
+func (c *classifier) classify(userAgent string) string {
+	userAgent = strings.TrimSpace(userAgent)
+	if len(userAgent) == 0 {
+		return clientUnknown
+	}
+	for _, p := range c.patterns {
+		if p.re.MatchString(userAgent) {
+			return p.category
+		}
+	}
+	return clientUnknown
+}
+
+// clientFor returns the category of the request's client, classifying it on first use
+func clientFor(req *http.Request) string {
+	record := recordFor(req)
+	if len(record.Client) == 0 {
+		record.Client = clients.classify(req.UserAgent())
+	}
+	return record.Client
+}
+
+type trafficKey struct {
+	site, rule, client string
+}
+
+// trafficUsage counts the requests to one rule from one category of client
+type trafficUsage struct {
+	Site   string `json:"site"`
+	Rule   string `json:"rule"`
+	Client string `json:"client"`
+	tally
+}
+
+// trafficStats counts requests per legacy rule and client category, to tell whether a
+// legacy host is still used by people or only by crawlers
+type trafficStats struct {
+	hitCounts[trafficKey, trafficUsage, *trafficUsage]
+}
+
+var traffic = newTrafficStats()
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{}
+}
+
+func (s *trafficStats) record(site, rule, client string, at time.Time) {
+	s.count(trafficKey{site, rule, client}, at, func(key trafficKey) *trafficUsage {
+		return &trafficUsage{Site: key.site, Rule: key.rule, Client: key.client}
+	}, nil)
+}
+
+// report returns the counts for every rule and client category, ordered by site and rule
+func (s *trafficStats) report() []trafficUsage {
+	usage := s.list(nil)
+
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i], usage[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Client < b.Client
+	})
+	return usage
+}
+
+func trafficReportHandler(w http.ResponseWriter, req *http.Request) {
+	usage := traffic.report()
+
+	rows := make([][]string, 0, len(usage))
+	for _, u := range usage {
+		rows = append(rows, []string{
+			u.Site,
+			u.Rule,
+			u.Client,
+			strconv.FormatInt(u.Hits, 10),
+			u.LastSeen.Format(time.RFC3339),
+		})
+	}
+	writeReport(w, req, usage, []string{"site", "rule", "client", "hits", "last_seen"}, rows)
+}
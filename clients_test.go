@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassifier(t *testing.T) {
+	Convey("Given the default classifier", t, func() {
+		c, err := newClassifier(nil)
+		So(err, ShouldBeNil)
+
+		Convey("Then user agents are classified by category", func() {
+			for ua, category := range map[string]string{
+				"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36": clientBrowser,
+				"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":                                    clientBot,
+				"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)":                                     clientBot,
+				"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/120.0 Safari/537.36":     clientBot,
+				"Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)":                                      clientMonitor,
+				"python-requests/2.31.0": clientAPI,
+				"curl/8.0":               clientAPI,
+				"Go-http-client/1.1":     clientAPI,
+				"Java/1.8.0_202":         clientAPI,
+				"":                       clientUnknown,
+				"SomethingElse/1.0":      clientUnknown,
+			} {
+				So(c.classify(ua), ShouldEqual, category)
+			}
+		})
+	})
+
+	Convey("Given configured patterns", t, func() {
+		c, err := newClassifier([]string{`bot=(?i)^ons-link-checker`, `browser=(?i)^curl/7\.29`})
+		So(err, ShouldBeNil)
+
+		Convey("Then they take precedence over the defaults", func() {
+			So(c.classify("ons-link-checker/1.0"), ShouldEqual, clientBot)
+			So(c.classify("curl/7.29.0"), ShouldEqual, clientBrowser)
+			So(c.classify("curl/8.0"), ShouldEqual, clientAPI)
+		})
+	})
+
+	Convey("Invalid patterns are rejected", t, func() {
+		for _, p := range []string{`robot=x`, `bot`, `bot=(`} {
+			_, err := newClassifier([]string{p})
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestTrafficReport(t *testing.T) {
+	Convey("Given requests to a legacy rule from different clients", t, func() {
+		traffic = newTrafficStats()
+		defer func() { traffic = newTrafficStats() }()
+
+		router, err := newTestRouter(healthcheck.HealthCheck{}, defaultRules())
+		So(err, ShouldBeNil)
+
+		for _, ua := range []string{"Googlebot/2.1", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"} {
+			req := httptest.NewRequest("GET", "https://web.ons.gov.uk/ons/api/a", nil)
+			req.Header.Set("User-Agent", ua)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Convey("Then hits are counted per rule and client category", func() {
+			usage := traffic.report()
+			So(usage, ShouldHaveLength, 2)
+			So(usage[0].Rule, ShouldEqual, "wda-api")
+			So(usage[0].Client, ShouldEqual, clientBot)
+			So(usage[0].Hits, ShouldEqual, 1)
+			So(usage[1].Client, ShouldEqual, clientBrowser)
+			So(usage[1].Hits, ShouldEqual, 2)
+			So(usage[1].LastSeen, ShouldHappenWithin, time.Minute, time.Now().UTC())
+		})
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// conditions restrict a route to requests with particular attributes, in addition to
+// its host and path. Every condition given must match.
+//
+// Header and query values are regular expressions matched against the value, so
+// "text/html" matches any Accept header listing HTML. A header or query parameter
+// with a condition must be present for the route to match.
+type conditions struct {
+	Methods []string          `json:"methods,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+	Clients []string          `json:"clients,omitempty"`
+}
+
+// compiledConditions is conditions ready to be matched against requests
+type compiledConditions struct {
+	methods map[string]bool
+	headers map[string]*regexp.Regexp
+	query   map[string]*regexp.Regexp
+	clients map[string]bool
+}
+
+func (c *conditions) compile() (*compiledConditions, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	cc := &compiledConditions{}
+	if len(c.Methods) > 0 {
+		cc.methods = make(map[string]bool, len(c.Methods))
+		for _, m := range c.Methods {
+			cc.methods[strings.ToUpper(m)] = true
+		}
+	}
+	if len(c.Headers) > 0 {
+		cc.headers = make(map[string]*regexp.Regexp, len(c.Headers))
+		for name, expr := range c.Headers {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid condition on header %s: %w", name, err)
+			}
+			cc.headers[http.CanonicalHeaderKey(name)] = re
+		}
+	}
+	if len(c.Query) > 0 {
+		cc.query = make(map[string]*regexp.Regexp, len(c.Query))
+		for name, expr := range c.Query {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid condition on query parameter %s: %w", name, err)
+			}
+			cc.query[name] = re
+		}
+	}
+	if len(c.Clients) > 0 {
+		cc.clients = make(map[string]bool, len(c.Clients))
+		for _, client := range c.Clients {
+			if !isClientCategory(client) {
+				return nil, fmt.Errorf("unknown client category %q", client)
+			}
+			cc.clients[client] = true
+		}
+	}
+	return cc, nil
+}
+
+// match implements mux.MatcherFunc
+func (cc *compiledConditions) match(req *http.Request, _ *mux.RouteMatch) bool {
+	if cc.methods != nil && !cc.methods[req.Method] {
+		return false
+	}
+	for name, re := range cc.headers {
+		values, ok := req.Header[name]
+		if !ok || !re.MatchString(strings.Join(values, ", ")) {
+			return false
+		}
+	}
+	if cc.query != nil {
+		query := req.URL.Query()
+		for name, re := range cc.query {
+			values, ok := query[name]
+			if !ok || !re.MatchString(strings.Join(values, ",")) {
+				return false
+			}
+		}
+	}
+	if cc.clients != nil && !cc.clients[clientFor(req)] {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConditionalRoutes(t *testing.T) {
+	Convey("Given a conditional route ahead of an unconditional route for the same path", t, func() {
+		rules := defaultRules()
+		rules.Sites[0].Routes = append([]route{{
+			ID:      "ness-api-browser",
+			Path:    "/NDE2/{uri:.*}",
+			Handler: "landing",
+			When: &conditions{
+				Methods: []string{"get"},
+				Headers: map[string]string{"accept": "text/html"},
+				Clients: []string{clientBrowser},
+			},
+		}, {
+			ID:      "ness-api-csv",
+			Path:    "/NDE2/{uri:.*}",
+			Handler: "landing",
+			When:    &conditions{Query: map[string]string{"format": "^csv$"}},
+		}}, rules.Sites[0].Routes...)
+		router, err := newTestRouter(healthcheck.HealthCheck{}, rules)
+		So(err, ShouldBeNil)
+
+		serve := func(method, target, accept, userAgent string) int {
+			req := httptest.NewRequest(method, target, nil)
+			if len(accept) > 0 {
+				req.Header.Set("Accept", accept)
+			}
+			req.Header.Set("User-Agent", userAgent)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+		browser := "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"
+		target := "http://neighbourhood.statistics.gov.uk/NDE2/Disco/GetAreas"
+
+		Convey("Then requests meeting every condition take the conditional route", func() {
+			So(serve("GET", target, "text/html,application/xhtml+xml", browser), ShouldEqual, redir)
+			So(serve("GET", target+"?format=csv", "", "curl/8.0"), ShouldEqual, redir)
+		})
+
+		Convey("Then other requests fall through to the next route", func() {
+			So(serve("GET", target, "application/xml", browser), ShouldEqual, http.StatusGone)
+			So(serve("GET", target, "", browser), ShouldEqual, http.StatusGone)
+			So(serve("POST", target, "text/html", browser), ShouldEqual, http.StatusGone)
+			So(serve("GET", target, "text/html", "python-requests/2.31"), ShouldEqual, http.StatusGone)
+			So(serve("GET", target+"?format=csvx", "", "curl/8.0"), ShouldEqual, http.StatusGone)
+		})
+
+		Convey("Then the client a request was already classified as is used", func() {
+			req, record := withRecord(httptest.NewRequest("GET", target, nil))
+			req.Header.Set("Accept", "text/html")
+			req.Header.Set("User-Agent", "curl/8.0")
+			record.Client = clientBrowser
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, redir)
+		})
+	})
+
+	Convey("Invalid conditions are rejected", t, func() {
+		for _, when := range []*conditions{
+			{Headers: map[string]string{"Accept": "("}},
+			{Query: map[string]string{"q": "("}},
+			{Clients: []string{"robot"}},
+		} {
+			rules := defaultRules()
+			rules.Sites[0].Routes[0].When = when
+			So(rules.validate(), ShouldNotBeNil)
+			_, err := rules.handler()
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
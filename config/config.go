@@ -8,9 +8,39 @@ import (
 
 // Config represents service configuration for dp-legacy-redirector
 type Config struct {
-	BindAddr                   string        `envconfig:"BIND_ADDR"`
-	HealthckeckCriticalTimeout time.Duration `envconfig:"HEALTHCHECK_CRITICAL_TIMEOUT"`
-	HealthckeckInterval        time.Duration `envconfig:"HEALTHCHECK_INTERVAL"`
+	BindAddr                   string            `envconfig:"BIND_ADDR"`
+	HealthckeckCriticalTimeout time.Duration     `envconfig:"HEALTHCHECK_CRITICAL_TIMEOUT"`
+	HealthckeckInterval        time.Duration     `envconfig:"HEALTHCHECK_INTERVAL"`
+	AllowedRedirectHosts       []string          `envconfig:"ALLOWED_REDIRECT_HOSTS"`
+	AllowedRedirectSchemes     []string          `envconfig:"ALLOWED_REDIRECT_SCHEMES"`
+	TrustedProxies             []string          `envconfig:"TRUSTED_PROXIES"`
+	RulesFile                  string            `envconfig:"RULES_FILE"`
+	ShadowRulesFile            string            `envconfig:"SHADOW_RULES_FILE"`
+	RulesStore                 string            `envconfig:"RULES_STORE"`
+	AuditLogFile               string            `envconfig:"AUDIT_LOG_FILE"`
+	AuditLogKey                string            `envconfig:"AUDIT_LOG_KEY"            json:"-"`
+	RulesPublicKeys            []string          `envconfig:"RULES_PUBLIC_KEYS"`
+	RequireSignedRules         bool              `envconfig:"REQUIRE_SIGNED_RULES"`
+	RulesReloadInterval        time.Duration     `envconfig:"RULES_RELOAD_INTERVAL"`
+	LocalisedLandingPages      bool              `envconfig:"LOCALISED_LANDING_PAGES"`
+	TLSCertFile                string            `envconfig:"TLS_CERT_FILE"`
+	TLSKeyFile                 string            `envconfig:"TLS_KEY_FILE"`
+	TLSReloadInterval          time.Duration     `envconfig:"TLS_RELOAD_INTERVAL"`
+	HTTPBindAddr               string            `envconfig:"HTTP_BIND_ADDR"`
+	AccessLogFormat            string            `envconfig:"ACCESS_LOG_FORMAT"`
+	AccessLogFile              string            `envconfig:"ACCESS_LOG_FILE"`
+	AccessLogMaxSizeMB         int               `envconfig:"ACCESS_LOG_MAX_SIZE_MB"`
+	AccessLogMaxBackups        int               `envconfig:"ACCESS_LOG_MAX_BACKUPS"`
+	RedactParams               []string          `envconfig:"REDACT_PARAMS"`
+	RedactPatterns             []string          `envconfig:"REDACT_PATTERNS"`
+	RedactPostcodes            bool              `envconfig:"REDACT_POSTCODES"`
+	RedactionKey               string            `envconfig:"REDACTION_KEY"            json:"-"`
+	UserAgentPatterns          []string          `envconfig:"USER_AGENT_PATTERNS"`
+	AdminBindAddr              string            `envconfig:"ADMIN_BIND_ADDR"`
+	AdminToken                 string            `envconfig:"ADMIN_TOKEN"              json:"-"`
+	AdminTokens                map[string]string `envconfig:"ADMIN_TOKENS"             json:"-"`
+	DrainPeriod                time.Duration     `envconfig:"DRAIN_PERIOD"`
+	GracefulShutdownTimeout    time.Duration     `envconfig:"GRACEFUL_SHUTDOWN_TIMEOUT"`
 }
 
 var cfg *Config
@@ -21,11 +51,32 @@ func Get() (*Config, error) {
 		return cfg, nil
 	}
 
-	cfg := &Config{
+	cfg := Default()
+	return cfg, envconfig.Process("", cfg)
+}
+
+// Default returns the config used when no environment variables are set
+func Default() *Config {
+	return &Config{
 		BindAddr:                   ":24600",
 		HealthckeckCriticalTimeout: time.Minute,
 		HealthckeckInterval:        time.Second * 10,
+		AllowedRedirectHosts: []string{
+			"www.ons.gov.uk",
+			"cy.ons.gov.uk",
+			"static.ons.gov.uk",
+			"webarchive.nationalarchives.gov.uk",
+		},
+		AllowedRedirectSchemes:  []string{"https", "http"},
+		RulesReloadInterval:     time.Minute,
+		TLSReloadInterval:       time.Minute,
+		AccessLogFormat:         "json",
+		AccessLogMaxSizeMB:      100,
+		AccessLogMaxBackups:     5,
+		RedactParams:            []string{"apikey", "api_key", "key", "token", "postcode", "pcode"},
+		RedactPostcodes:         true,
+		AdminBindAddr:           "localhost:24601",
+		DrainPeriod:             time.Second * 15,
+		GracefulShutdownTimeout: time.Second * 10,
 	}
-
-	return cfg, envconfig.Process("", cfg)
 }
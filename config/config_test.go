@@ -21,6 +21,36 @@ func TestSpec(t *testing.T) {
 				So(cfg.BindAddr, ShouldEqual, ":24600")
 				So(cfg.HealthckeckCriticalTimeout, ShouldEqual, time.Minute)
 				So(cfg.HealthckeckInterval, ShouldEqual, time.Second*10)
+				So(cfg.AllowedRedirectHosts, ShouldResemble, []string{"www.ons.gov.uk", "cy.ons.gov.uk", "static.ons.gov.uk", "webarchive.nationalarchives.gov.uk"})
+				So(cfg.AllowedRedirectSchemes, ShouldResemble, []string{"https", "http"})
+				So(cfg.TrustedProxies, ShouldBeEmpty)
+				So(cfg.RulesFile, ShouldBeEmpty)
+				So(cfg.ShadowRulesFile, ShouldBeEmpty)
+				So(cfg.RulesStore, ShouldBeEmpty)
+				So(cfg.AuditLogFile, ShouldBeEmpty)
+				So(cfg.AuditLogKey, ShouldBeEmpty)
+				So(cfg.RulesPublicKeys, ShouldBeEmpty)
+				So(cfg.RequireSignedRules, ShouldBeFalse)
+				So(cfg.RulesReloadInterval, ShouldEqual, time.Minute)
+				So(cfg.LocalisedLandingPages, ShouldBeFalse)
+				So(cfg.TLSCertFile, ShouldBeEmpty)
+				So(cfg.TLSKeyFile, ShouldBeEmpty)
+				So(cfg.TLSReloadInterval, ShouldEqual, time.Minute)
+				So(cfg.HTTPBindAddr, ShouldBeEmpty)
+				So(cfg.AccessLogFormat, ShouldEqual, "json")
+				So(cfg.AccessLogFile, ShouldBeEmpty)
+				So(cfg.AccessLogMaxSizeMB, ShouldEqual, 100)
+				So(cfg.AccessLogMaxBackups, ShouldEqual, 5)
+				So(cfg.RedactParams, ShouldResemble, []string{"apikey", "api_key", "key", "token", "postcode", "pcode"})
+				So(cfg.RedactPatterns, ShouldBeEmpty)
+				So(cfg.RedactPostcodes, ShouldBeTrue)
+				So(cfg.RedactionKey, ShouldBeEmpty)
+				So(cfg.UserAgentPatterns, ShouldBeEmpty)
+				So(cfg.AdminBindAddr, ShouldEqual, "localhost:24601")
+				So(cfg.AdminToken, ShouldBeEmpty)
+				So(cfg.AdminTokens, ShouldBeEmpty)
+				So(cfg.DrainPeriod, ShouldEqual, time.Second*15)
+				So(cfg.GracefulShutdownTimeout, ShouldEqual, time.Second*10)
 			})
 		})
 	})
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/ONSdigital/dp-legacy-redirector/config"
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+var (
+	errUnsafeSegment     = errors.New("path segment contains unsafe characters")
+	errInvalidScheme     = errors.New("destination scheme is not allowed")
+	errInvalidHost       = errors.New("destination host is not allowed")
+	errInvalidUserInfo   = errors.New("destination must not contain user info")
+	errUnparsableAddress = errors.New("destination could not be parsed")
+)
+
+// destinationPolicy restricts the schemes and hosts that a redirect may send users to
+type destinationPolicy struct {
+	hosts   map[string]bool
+	schemes map[string]bool
+}
+
+// destinations is replaced in main with the policy from the service configuration, and
+// until then is the policy from the default configuration
+var destinations = newDestinationPolicy(config.Default().AllowedRedirectHosts, config.Default().AllowedRedirectSchemes)
+
+func newDestinationPolicy(hosts, schemes []string) *destinationPolicy {
+	p := &destinationPolicy{
+		hosts:   make(map[string]bool, len(hosts)),
+		schemes: make(map[string]bool, len(schemes)),
+	}
+	for _, h := range hosts {
+		p.hosts[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	for _, s := range schemes {
+		p.schemes[strings.ToLower(strings.TrimSpace(s))] = true
+	}
+	return p
+}
+
+// check parses dest and returns it in canonical form if it is permitted by the policy
+func (p *destinationPolicy) check(dest string) (string, error) {
+	if hasControlChars(dest) {
+		return "", errUnsafeSegment
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", errUnparsableAddress
+	}
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return "", errInvalidScheme
+	}
+	if u.User != nil {
+		return "", errInvalidUserInfo
+	}
+	if !p.hosts[strings.ToLower(u.Hostname())] {
+		return "", errInvalidHost
+	}
+
+	return u.String(), nil
+}
+
+// cleanSegment normalises a user supplied path segment before it is appended to a
+// destination, so it can't escape its prefix with dot segments or leading slashes
+func cleanSegment(segment string) (string, error) {
+	if hasControlChars(segment) || strings.Contains(segment, `\`) {
+		return "", errUnsafeSegment
+	}
+	if len(segment) == 0 {
+		return "", nil
+	}
+
+	cleaned := strings.TrimLeft(path.Clean("/"+segment), "/")
+	if strings.HasSuffix(segment, "/") && len(cleaned) > 0 {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// hasControlChars reports whether s contains raw or percent-encoded CR, LF or NUL characters
+func hasControlChars(s string) bool {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return true
+	}
+	lower := strings.ToLower(s)
+	return strings.Contains(lower, "%0d") || strings.Contains(lower, "%0a") || strings.Contains(lower, "%00")
+}
+
+// redirect validates dest against the destination policy and either redirects to it
+// or rejects the request with a 400 and a security log event. data is copied into the
+// log event only when one is written, so callers' data needn't be allocated.
+func redirect(w http.ResponseWriter, req *http.Request, event, dest string, data log.Data) {
+	checked, err := destinations.check(dest)
+	if err != nil {
+		rejectDestination(w, req, dest, err)
+		return
+	}
+
+	if !shadowing(req) {
+		logged := log.Data{
+			"host":   req.Host,
+			"path":   req.URL.Path,
+			"scheme": requestScheme(req),
+			"dest":   checked,
+		}
+		for k, v := range data {
+			logged[k] = v
+		}
+		log.Info(req.Context(), event, logged)
+	}
+	recordFor(req).Outcome = "redirect"
+
+	w.Header().Set("Location", checked)
+	w.WriteHeader(redir)
+}
+
+func rejectDestination(w http.ResponseWriter, req *http.Request, dest string, err error) {
+	if !shadowing(req) {
+		log.Event(req.Context(), "security: rejected redirect destination", log.WARN, log.Data{
+			"security": true,
+			"reason":   err.Error(),
+			"host":     req.Host,
+			"path":     req.URL.Path,
+			"dest":     strings.ToValidUTF8(strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(dest), ""),
+		})
+	}
+	recordFor(req).Outcome = "rejected"
+	w.WriteHeader(http.StatusBadRequest)
+}
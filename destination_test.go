@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	Convey("Given the default destination policy", t, func() {
+		p := newDestinationPolicy([]string{"www.ons.gov.uk", "static.ons.gov.uk"}, []string{"https"})
+
+		Convey("Then destinations on allowed hosts are accepted", func() {
+			dest, err := p.check("https://WWW.ons.gov.uk/help/localstatistics")
+			So(err, ShouldBeNil)
+			So(dest, ShouldEqual, "https://WWW.ons.gov.uk/help/localstatistics")
+		})
+
+		Convey("Then other hosts are rejected", func() {
+			_, err := p.check("https://evil.com/")
+			So(err, ShouldEqual, errInvalidHost)
+			_, err = p.check("https://www.ons.gov.uk.evil.com/")
+			So(err, ShouldEqual, errInvalidHost)
+		})
+
+		Convey("Then other schemes are rejected", func() {
+			_, err := p.check("javascript://www.ons.gov.uk/%0aalert(1)")
+			So(err, ShouldNotBeNil)
+			_, err = p.check("http://www.ons.gov.uk/")
+			So(err, ShouldEqual, errInvalidScheme)
+		})
+
+		Convey("Then user info and control characters are rejected", func() {
+			_, err := p.check("https://evil.com@www.ons.gov.uk/")
+			So(err, ShouldEqual, errInvalidUserInfo)
+			_, err = p.check("https://www.ons.gov.uk/a\r\nSet-Cookie: x")
+			So(err, ShouldEqual, errUnsafeSegment)
+		})
+	})
+}
+
+func TestCleanSegment(t *testing.T) {
+	Convey("cleanSegment normalises user supplied path segments", t, func() {
+		for in, out := range map[string]string{
+			"":               "",
+			"a/b/c":          "a/b/c",
+			"a/b/c/":         "a/b/c/",
+			"//evil.com":     "evil.com",
+			"/a//b":          "a/b",
+			"../../evil.com": "evil.com",
+			"a/./b/../c":     "a/c",
+		} {
+			cleaned, err := cleanSegment(in)
+			So(err, ShouldBeNil)
+			So(cleaned, ShouldEqual, out)
+		}
+
+		for _, in := range []string{"a%0d%0ab", "a%0Ab", "a\nb", `\\evil.com`, "a%00"} {
+			_, err := cleanSegment(in)
+			So(err, ShouldEqual, errUnsafeSegment)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Kinds of ruleChange
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeChanged = "changed"
+)
+
+// ruleChange is a difference between two rule sets. Path names the part of the rule set
+// that changed, such as sites/visual/routes/visual-article or sites/visual/redirects/<slug>,
+// and Old and New are its values, as JSON unless they are plain strings.
+type ruleChange struct {
+	Change string `json:"change"`
+	Path   string `json:"path"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// diffRules returns the differences between two rule sets, ordered by path. Versions
+// are not compared.
+func diffRules(from, to *ruleSet) []ruleChange {
+	old, updated := flattenRules(from), flattenRules(to)
+
+	var changes []ruleChange
+	for _, path := range sortedKeys(old) {
+		switch v, ok := updated[path]; {
+		case !ok:
+			changes = append(changes, ruleChange{Change: changeRemoved, Path: path, Old: old[path]})
+		case v != old[path]:
+			changes = append(changes, ruleChange{Change: changeChanged, Path: path, Old: old[path], New: v})
+		}
+	}
+	for _, path := range sortedKeys(updated) {
+		if _, ok := old[path]; !ok {
+			changes = append(changes, ruleChange{Change: changeAdded, Path: path, New: updated[path]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// flattenRules maps the paths of the parts of rs that can change independently to their
+// values. Sites with visual-article routes include the redirects they use, built-in or not.
+func flattenRules(rs *ruleSet) map[string]string {
+	flat := map[string]string{}
+	put := func(path string, v interface{}) {
+		b, _ := json.Marshal(v)
+		flat[path] = string(b)
+	}
+
+	put("responses", rs.responses)
+	for alias, canonical := range rs.Aliases {
+		flat["aliases/"+alias] = canonical
+	}
+
+	names := make([]string, 0, len(rs.Sites))
+	for _, s := range rs.Sites {
+		names = append(names, s.Name)
+		prefix := "sites/" + s.Name
+		put(prefix+"/hosts", s.Hosts)
+		put(prefix+"/responses", s.responses)
+		for host, r := range s.HostResponses {
+			put(prefix+"/host_responses/"+host, r)
+		}
+
+		ids := make([]string, 0, len(s.Routes))
+		redirects := s.Redirects
+		for _, r := range s.Routes {
+			ids = append(ids, r.ID)
+			put(prefix+"/routes/"+r.ID, r)
+			if r.Handler == "visual-article" || (r.Canary != nil && r.Canary.Handler == "visual-article") {
+				redirects = s.articleRedirects()
+			}
+		}
+		put(prefix+"/route_order", ids)
+		for slug, dest := range redirects {
+			flat[prefix+"/redirects/"+slug] = dest
+		}
+	}
+	put("site_order", names)
+	return flat
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiffRules(t *testing.T) {
+	Convey("Given two versions of the built-in rules", t, func() {
+		from, to := defaultRules(), defaultRules()
+		to.Version = "2"
+		to.Aliases = map[string]string{"neighbourhood.ons.gov.uk": "neighbourhood.statistics.gov.uk"}
+		to.Sites[1].Routes = to.Sites[1].Routes[1:]
+		to.Sites[3].Redirects = map[string]string{"baby-names": "https://www.ons.gov.uk/babynames"}
+
+		Convey("Then added, removed and changed parts are listed by path", func() {
+			changes := diffRules(from, to)
+			So(changes[0], ShouldResemble, ruleChange{Change: changeAdded, Path: "aliases/neighbourhood.ons.gov.uk", New: "neighbourhood.statistics.gov.uk"})
+			So(changes, ShouldContain, ruleChange{Change: changeRemoved, Path: "sites/wda/routes/wda-website", Old: `{"id":"wda-website","path":"/ons/apiservice/web/{uri:.*}","handler":"landing"}`})
+			So(changes, ShouldContain, ruleChange{Change: changeChanged, Path: "sites/visual/redirects/baby-names", Old: visualRedirects["baby-names"], New: "https://www.ons.gov.uk/babynames"})
+			So(changes, ShouldContain, ruleChange{Change: changeRemoved, Path: "sites/visual/redirects/gdp-and-me", Old: visualRedirects["gdp-and-me"]})
+		})
+
+		Convey("Then identical rule sets have no differences, whatever their version", func() {
+			So(diffRules(from, defaultRules()), ShouldBeEmpty)
+			from.Version = "other"
+			So(diffRules(from, defaultRules()), ShouldBeEmpty)
+		})
+	})
+}
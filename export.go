@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Formats the export command renders rule sets to
+const (
+	exportNginx      = "nginx"
+	exportApache     = "apache"
+	exportCloudFront = "cloudfront"
+)
+
+// exportPart is a literal piece of a redirect destination, or a reference to a
+// capture group of the route's path
+type exportPart struct {
+	literal string
+	group   int
+}
+
+// exportLookup redirects to the value in table keyed by a capture group, if there is one
+type exportLookup struct {
+	group int
+	table map[string]string
+}
+
+// exportRule is a route reduced to a path regular expression and a response that edge
+// servers can reproduce
+type exportRule struct {
+	id          string
+	path        string
+	target      []exportPart
+	lookup      *exportLookup
+	gone        bool
+	goneMessage string
+}
+
+// exportSite is a site's host regular expressions and rules. A site with no hosts
+// matches any host.
+type exportSite struct {
+	name  string
+	hosts []string
+	rules []exportRule
+}
+
+// exportModel is a rule set in a form that can be rendered to edge server configuration.
+// Warnings describe anything that couldn't be exported faithfully.
+type exportModel struct {
+	version  string
+	sites    []exportSite
+	warnings []string
+}
+
+var muxGroup = regexp.MustCompile(`\(\?P<v[0-9]+>`)
+
+// newExportModel reduces rs to the routes that can be served without the redirector.
+// Routes with conditions, expressions or canaries are skipped, as are routes that
+// aren't in effect at now.
+func newExportModel(rs *ruleSet, now time.Time) (*exportModel, error) {
+	m := &exportModel{version: rs.Version}
+	defaults := rs.responses.inherit(responses{LandingPage: landingPage, GoneMessage: apiResponse})
+	if len(defaults.Languages) > 0 {
+		m.warn("translated responses aren't exported, English responses are used for every language")
+	}
+
+	for _, s := range rs.Sites {
+		hosts, err := compileHostPatterns(s.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", s.Name, err)
+		}
+		var hostExprs []string
+		for _, re := range hosts {
+			hostExprs = append(hostExprs, re.String())
+		}
+		if len(hostExprs) > 0 {
+			for _, alias := range sortedKeys(rs.Aliases) {
+				if hosts.match(&http.Request{Host: rs.Aliases[alias]}, nil) {
+					hostExprs = append(hostExprs, "^"+regexp.QuoteMeta(normaliseHost(alias))+"$")
+				}
+			}
+		}
+
+		siteResponses := s.responses.inherit(defaults)
+		if len(s.Languages) > 0 {
+			m.warn("site %s: translated responses aren't exported", s.Name)
+		}
+
+		for _, host := range sortedKeys(s.HostResponses) {
+			rules, err := m.exportRoutes(s, s.HostResponses[host].inherit(siteResponses), now)
+			if err != nil {
+				return nil, err
+			}
+			m.sites = append(m.sites, exportSite{
+				name:  s.Name + " (" + host + ")",
+				hosts: []string{"^" + regexp.QuoteMeta(normaliseHost(host)) + "$"},
+				rules: rules,
+			})
+		}
+
+		rules, err := m.exportRoutes(s, siteResponses, now)
+		if err != nil {
+			return nil, err
+		}
+		m.sites = append(m.sites, exportSite{name: s.Name, hosts: hostExprs, rules: rules})
+	}
+	return m, nil
+}
+
+func (m *exportModel) warn(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	for _, w := range m.warnings {
+		if w == warning {
+			return
+		}
+	}
+	m.warnings = append(m.warnings, warning)
+}
+
+// exportRoutes returns the export rules for the routes of s, using resp for landing
+// pages and gone messages
+func (m *exportModel) exportRoutes(s site, resp responses, now time.Time) ([]exportRule, error) {
+	var rules []exportRule
+	for _, r := range s.Routes {
+		switch {
+		case r.When != nil || len(r.If) > 0:
+			m.warn("site %s: route %s has conditions and isn't exported", s.Name, r.ID)
+			continue
+		case len(r.Destination) > 0:
+			m.warn("site %s: route %s has a destination expression and isn't exported", s.Name, r.ID)
+			continue
+		case r.Canary != nil:
+			m.warn("site %s: route %s has a canary, only its control arm is exported", s.Name, r.ID)
+		}
+		if r.EffectiveFrom != nil || r.ExpiresAt != nil {
+			if window, _ := newActiveWindow(r.EffectiveFrom, r.ExpiresAt); !window.activeAt(now) {
+				m.warn("site %s: route %s isn't in effect and isn't exported", s.Name, r.ID)
+				continue
+			}
+			m.warn("site %s: route %s is exported without its effective period", s.Name, r.ID)
+		}
+
+		route := mux.NewRouter().Path(r.Path)
+		pathExpr, err := route.GetPathRegexp()
+		if err != nil {
+			return nil, fmt.Errorf("site %s: route %s: %w", s.Name, r.ID, err)
+		}
+		names, err := route.GetVarNames()
+		if err != nil {
+			return nil, fmt.Errorf("site %s: route %s: %w", s.Name, r.ID, err)
+		}
+		groups := make(map[string]int, len(names))
+		for i, name := range names {
+			groups[name] = i + 1
+		}
+		pathExpr = muxGroup.ReplaceAllString(pathExpr, "(")
+
+		rule := exportRule{id: r.ID, path: pathExpr}
+		switch r.Handler {
+		case "landing":
+			rule.target = []exportPart{{literal: resp.LandingPage}}
+		case "gone":
+			rule.gone = true
+			rule.goneMessage = resp.GoneMessage
+		case "ness-content", "visual-asset":
+			prefix := nessContentPrefix
+			if r.Handler == "visual-asset" {
+				prefix = visualAssetPrefix
+			}
+			if groups["uri"] == 0 {
+				return nil, fmt.Errorf("site %s: route %s: handler %s needs a {uri} variable", s.Name, r.ID, r.Handler)
+			}
+			rule.target = []exportPart{{literal: prefix}, {group: groups["uri"]}}
+		case "visual-article":
+			article, uri := groups["article"], groups["uri"]
+			if article == 0 || uri == 0 {
+				return nil, fmt.Errorf("site %s: route %s: handler %s needs {article} and {uri} variables", s.Name, r.ID, r.Handler)
+			}
+			rules = append(rules, exportRule{id: r.ID + "-home", path: `^/(?:/.*)?$`, target: []exportPart{{literal: visualHome}}})
+			rule.lookup = &exportLookup{group: article, table: s.articleRedirects()}
+			rule.target = []exportPart{{literal: visualArchivePrefix}, {group: article}, {group: uri}}
+		default:
+			return nil, fmt.Errorf("site %s: route %s: handler %s can't be exported", s.Name, r.ID, r.Handler)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// rulesFor returns the rules applying to requests for site i, including those of any
+// site matching every host, in the order the router tries them
+func (m *exportModel) rulesFor(i int) []exportRule {
+	var rules []exportRule
+	for j, s := range m.sites {
+		if j == i || len(s.hosts) == 0 {
+			rules = append(rules, s.rules...)
+		}
+	}
+	return rules
+}
+
+// nginx renders m as nginx server blocks, to be included in the http block
+func (m *exportModel) nginx(w io.Writer) error {
+	var b strings.Builder
+	m.header(&b, "#", "Include in the http block.")
+
+	mapped := map[string]bool{}
+	for _, s := range m.sites {
+		for _, r := range s.rules {
+			if r.lookup == nil || mapped[r.id] {
+				continue
+			}
+			mapped[r.id] = true
+			fmt.Fprintf(&b, "map $uri %s {\n    default \"\";\n", nginxLookupVar(r))
+			for _, key := range sortedKeys(r.lookup.table) {
+				fmt.Fprintf(&b, "    %s %s;\n", nginxQuote("~^/"+regexp.QuoteMeta(key)+"(?:/.*)?$"), nginxQuote(r.lookup.table[key]))
+			}
+			b.WriteString("}\n\n")
+		}
+	}
+
+	hasDefault := false
+	for i, s := range m.sites {
+		if len(s.hosts) == 0 {
+			if hasDefault {
+				continue
+			}
+			hasDefault = true
+		}
+
+		fmt.Fprintf(&b, "# %s\nserver {\n", s.name)
+		if len(s.hosts) == 0 {
+			b.WriteString("    listen 80 default_server;\n    server_name _;\n")
+		} else {
+			b.WriteString("    listen 80;\n    server_name")
+			for _, h := range s.hosts {
+				b.WriteString(" " + nginxQuote("~"+h))
+			}
+			b.WriteString(";\n")
+		}
+		b.WriteString("    default_type \"text/plain; charset=utf-8\";\n\n")
+
+		for _, r := range m.rulesFor(i) {
+			fmt.Fprintf(&b, "    # %s\n", r.id)
+			if r.lookup != nil {
+				v := nginxLookupVar(r)
+				fmt.Fprintf(&b, "    if (%s != \"\") {\n        return 307 %s;\n    }\n", v, v)
+			}
+			fmt.Fprintf(&b, "    if ($uri ~ %s) {\n", nginxQuote(r.path))
+			if r.gone {
+				fmt.Fprintf(&b, "        return 410 %s;\n", nginxQuote(r.goneMessage))
+			} else {
+				fmt.Fprintf(&b, "        return 307 %s;\n", nginxQuote(renderTarget(r.target, "", func(s string) string { return s }, func(g int) string { return "$" + strconv.Itoa(g) })))
+			}
+			b.WriteString("    }\n")
+		}
+		b.WriteString("\n    return 404;\n}\n\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var nginxUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// nginxLookupVar returns the name of the variable mapped from the lookup table of r
+func nginxLookupVar(r exportRule) string {
+	return "$redirector_" + strings.Trim(nginxUnsafe.ReplaceAllString(strings.ToLower(r.id), "_"), "_")
+}
+
+// nginxQuote quotes s as an nginx string. Variables such as $1 in s are still expanded.
+func nginxQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// apache renders m as mod_rewrite rules, to be included in a virtual host
+func (m *exportModel) apache(w io.Writer) error {
+	var b strings.Builder
+	m.header(&b, "#", "Include in a VirtualHost with UseCanonicalName Off, so SERVER_NAME is the requested host.")
+	b.WriteString("RewriteEngine On\n")
+
+	var goneMessages []string
+	for _, s := range m.sites {
+		for _, r := range s.rules {
+			if r.gone && !containsString(goneMessages, r.goneMessage) {
+				goneMessages = append(goneMessages, r.goneMessage)
+			}
+		}
+	}
+	if len(goneMessages) > 0 {
+		if len(goneMessages) > 1 {
+			b.WriteString("# Apache has one 410 document per virtual host; other sites' gone messages aren't used\n")
+		}
+		fmt.Fprintf(&b, "ErrorDocument 410 %s\n", apacheQuote(goneMessages[0]))
+	}
+
+	for _, s := range m.sites {
+		fmt.Fprintf(&b, "\n# %s\n", s.name)
+		hostCond := ""
+		if len(s.hosts) > 0 {
+			hostCond = "RewriteCond %{SERVER_NAME} " + apacheQuote("(?:"+strings.Join(s.hosts, "|")+")") + " [NC]\n"
+		}
+		for _, r := range s.rules {
+			if r.lookup != nil {
+				for _, key := range sortedKeys(r.lookup.table) {
+					b.WriteString(hostCond)
+					fmt.Fprintf(&b, "RewriteRule %s %s [R=307,L,NE]\n", apacheQuote("^/"+regexp.QuoteMeta(key)+"(?:/.*)?$"), apacheQuote(apacheEscape(r.lookup.table[key])))
+				}
+			}
+			b.WriteString(hostCond)
+			if r.gone {
+				fmt.Fprintf(&b, "RewriteRule %s - [G,L]\n", apacheQuote(r.path))
+			} else {
+				fmt.Fprintf(&b, "RewriteRule %s %s [R=307,L,NE]\n", apacheQuote(r.path), apacheQuote(renderTarget(r.target, "", apacheEscape, func(g int) string { return "$" + strconv.Itoa(g) })))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// apacheEscape escapes the characters mod_rewrite expands in substitutions
+func apacheEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `$`, `\$`, `%`, `\%`).Replace(s)
+}
+
+func apacheQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, `\"`, "\n", " ").Replace(s) + `"`
+}
+
+// cloudfront renders m as a CloudFront Functions viewer request handler (runtime 2.0)
+func (m *exportModel) cloudfront(w io.Writer) error {
+	var b strings.Builder
+	m.header(&b, "//", "Deploy as a viewer request CloudFront Function using the cloudfront-js-2.0 runtime.")
+
+	b.WriteString("var sites = [\n")
+	for _, s := range m.sites {
+		fmt.Fprintf(&b, "  {\n    name: %s,\n    hosts: [", jsString(s.name))
+		for i, h := range s.hosts {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(jsRegExp(h))
+		}
+		b.WriteString("],\n    routes: [\n")
+		for _, r := range s.rules {
+			fmt.Fprintf(&b, "      {id: %s, path: %s, ", jsString(r.id), jsRegExp(r.path))
+			switch {
+			case r.gone:
+				fmt.Fprintf(&b, "gone: %s", jsString(r.goneMessage))
+			default:
+				target := renderTarget(r.target, " + ", jsString, func(g int) string { return "m[" + strconv.Itoa(g) + "]" })
+				if r.lookup != nil {
+					table, _ := json.Marshal(r.lookup.table)
+					fmt.Fprintf(&b, "lookup: %s, lookupGroup: %d, ", table, r.lookup.group)
+				}
+				fmt.Fprintf(&b, "redirect: function (m) { return %s; }", target)
+			}
+			b.WriteString("},\n")
+		}
+		b.WriteString("    ]\n  },\n")
+	}
+	b.WriteString(`];
+
+function handler(event) {
+  var request = event.request;
+  var host = request.headers.host ? request.headers.host.value.toLowerCase().replace(/:[0-9]+$/, "").replace(/\.$/, "") : "";
+
+  for (var i = 0; i < sites.length; i++) {
+    var site = sites[i];
+    if (site.hosts.length > 0 && !site.hosts.some(function (h) { return h.test(host); })) {
+      continue;
+    }
+    for (var j = 0; j < site.routes.length; j++) {
+      var route = site.routes[j];
+      var m = route.path.exec(request.uri);
+      if (!m) {
+        continue;
+      }
+      if (route.gone !== undefined) {
+        return {
+          statusCode: 410,
+          statusDescription: "Gone",
+          headers: {"content-type": {value: "text/plain; charset=utf-8"}},
+          body: {encoding: "text", data: route.gone}
+        };
+      }
+      var location = route.lookup && Object.prototype.hasOwnProperty.call(route.lookup, m[route.lookupGroup])
+        ? route.lookup[m[route.lookupGroup]]
+        : route.redirect(m);
+      return {
+        statusCode: 307,
+        statusDescription: "Temporary Redirect",
+        headers: {location: {value: location}}
+      };
+    }
+  }
+  return {statusCode: 404, statusDescription: "Not Found"};
+}
+`)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// jsString quotes s as a JavaScript string literal
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// jsRegExp returns a JavaScript RegExp for a Go regular expression, moving a leading
+// case-insensitive flag into the RegExp flags
+func jsRegExp(expr string) string {
+	flags := ""
+	if strings.HasPrefix(expr, "(?i)") {
+		expr, flags = expr[4:], "i"
+	}
+	return "new RegExp(" + jsString(expr) + ", " + jsString(flags) + ")"
+}
+
+// renderTarget joins the parts of a destination with sep, formatting literals and group
+// references for the output format
+func renderTarget(parts []exportPart, sep string, literal func(string) string, group func(int) string) string {
+	rendered := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.group > 0 {
+			rendered = append(rendered, group(p.group))
+		} else {
+			rendered = append(rendered, literal(p.literal))
+		}
+	}
+	return strings.Join(rendered, sep)
+}
+
+func (m *exportModel) header(b *strings.Builder, comment, usage string) {
+	fmt.Fprintf(b, "%s Generated by dp-legacy-redirector export from rules version %s.\n", comment, m.version)
+	fmt.Fprintf(b, "%s %s\n", comment, usage)
+	for _, w := range m.warnings {
+		fmt.Fprintf(b, "%s Warning: %s\n", comment, w)
+	}
+	b.WriteString("\n")
+}
+
+// exportCommand renders a rule set to edge server configuration
+func exportCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	rulesFile := fs.String("rules", "builtin", "rules file to export, or builtin")
+	format := fs.String("format", exportNginx, "output format: nginx, apache or cloudfront")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rules := defaultRules()
+	if *rulesFile != "builtin" {
+		var err error
+		if rules, err = loadRules(*rulesFile); err != nil {
+			return err
+		}
+	}
+
+	m, err := newExportModel(rules, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, w := range m.warnings {
+		fmt.Fprintln(stderr, "warning:", w)
+	}
+
+	switch *format {
+	case exportNginx:
+		return m.nginx(stdout)
+	case exportApache:
+		return m.apache(stdout)
+	case exportCloudFront:
+		return m.cloudfront(stdout)
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// exportCase is a request and the response the router gave it
+type exportCase struct {
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Code     int    `json:"code"`
+	Location string `json:"location"`
+	Body     string `json:"body"`
+}
+
+// exportCorpus returns the redirect tests, every visual article with and without a trailing
+// path, and requests for unknown hosts, with the built-in router's responses
+func exportCorpus(t *testing.T) []exportCase {
+	var urls []string
+	for _, test := range tests {
+		if test.code != 400 {
+			urls = append(urls, test.url)
+		}
+	}
+	for _, article := range sortedKeys(visualRedirects) {
+		urls = append(urls, "https://visual.ons.gov.uk/"+article, "https://visual.ons.gov.uk/"+article+"/x")
+	}
+	urls = append(urls, "https://example.com/", "https://example.com/HTMLDocs/a")
+
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	router, err := newTestRouter(healthcheck.New(versionInfo, time.Second*10, time.Minute), defaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases []exportCase
+	for _, u := range urls {
+		req := httptest.NewRequest("GET", u, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		parsed, _ := url.Parse(u)
+		cases = append(cases, exportCase{Host: parsed.Host, Path: parsed.Path, Code: w.Code, Location: w.Header().Get("Location"), Body: w.Body.String()})
+	}
+	return cases
+}
+
+// nginxConfig is rendered nginx configuration read back, to answer requests the way
+// nginx would with it. Only what the export command writes is understood, and Go's
+// regular expressions stand in for PCRE.
+type nginxConfig struct {
+	maps    map[string][]nginxMapEntry
+	servers []nginxServer
+}
+
+type nginxMapEntry struct {
+	key   *regexp.Regexp
+	value string
+}
+
+type nginxServer struct {
+	names       []*regexp.Regexp
+	defaultName bool
+	rules       []nginxRule
+}
+
+// nginxRule is an if block returning code and text, either when variable isn't empty or
+// when $uri matches path
+type nginxRule struct {
+	variable string
+	path     *regexp.Regexp
+	code     int
+	text     string
+}
+
+var (
+	nginxString      = `"((?:[^"\\]|\\.)*)"`
+	nginxMapStart    = regexp.MustCompile(`^map \$uri (\$\w+) \{$`)
+	nginxMapEntryRe  = regexp.MustCompile(`^` + nginxString + ` ` + nginxString + `;$`)
+	nginxServerNames = regexp.MustCompile(`^server_name((?: ` + nginxString + `)+);$`)
+	nginxQuoted      = regexp.MustCompile(nginxString)
+	nginxIfVariable  = regexp.MustCompile(`^if \((\$\w+) != ""\) \{$`)
+	nginxIfURI       = regexp.MustCompile(`^if \(\$uri ~ ` + nginxString + `\) \{$`)
+	nginxReturn      = regexp.MustCompile(`^return ([0-9]+)(?: (\$\w+|` + nginxString + `))?;$`)
+)
+
+// nginxUnquote reverses nginx's escapes in a quoted string
+func nginxUnquote(s string) string {
+	return regexp.MustCompile(`\\(.)`).ReplaceAllStringFunc(s, func(e string) string {
+		if e[1] == 'n' {
+			return "\n"
+		}
+		return e[1:]
+	})
+}
+
+// parseNginx reads back configuration written by the nginx export
+func parseNginx(conf string) (*nginxConfig, error) {
+	c := &nginxConfig{maps: map[string][]nginxMapEntry{}}
+	var mapVar string
+	var server *nginxServer
+	var rule *nginxRule
+	for i, line := range strings.Split(conf, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var groups []string
+		match := func(re *regexp.Regexp) bool {
+			groups = re.FindStringSubmatch(line)
+			return groups != nil
+		}
+
+		switch {
+		case len(mapVar) > 0 && line == "}":
+			mapVar = ""
+		case len(mapVar) > 0 && line == `default "";`:
+		case len(mapVar) > 0 && match(nginxMapEntryRe):
+			key := nginxUnquote(groups[1])
+			if !strings.HasPrefix(key, "~") {
+				return nil, fmt.Errorf("line %d: map key isn't a regular expression", i+1)
+			}
+			re, err := regexp.Compile(key[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			c.maps[mapVar] = append(c.maps[mapVar], nginxMapEntry{key: re, value: nginxUnquote(groups[2])})
+		case server == nil && match(nginxMapStart):
+			mapVar = groups[1]
+		case server == nil && line == "server {":
+			c.servers = append(c.servers, nginxServer{})
+			server = &c.servers[len(c.servers)-1]
+		case server == nil:
+			return nil, fmt.Errorf("line %d: unexpected %q", i+1, line)
+		case rule == nil && line == "}":
+			server = nil
+		case rule == nil && (line == "listen 80;" || line == `default_type "text/plain; charset=utf-8";`):
+		case rule == nil && line == "listen 80 default_server;":
+			server.defaultName = true
+		case rule == nil && line == "server_name _;":
+		case rule == nil && match(nginxServerNames):
+			for _, quoted := range nginxQuoted.FindAllStringSubmatch(groups[1], -1) {
+				name := nginxUnquote(quoted[1])
+				if !strings.HasPrefix(name, "~") {
+					return nil, fmt.Errorf("line %d: server name isn't a regular expression", i+1)
+				}
+				re, err := regexp.Compile(name[1:])
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", i+1, err)
+				}
+				server.names = append(server.names, re)
+			}
+		case rule == nil && match(nginxIfVariable):
+			rule = &nginxRule{variable: groups[1]}
+		case rule == nil && match(nginxIfURI):
+			re, err := regexp.Compile(nginxUnquote(groups[1]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			rule = &nginxRule{path: re}
+		case match(nginxReturn):
+			code, _ := strconv.Atoi(groups[1])
+			text := groups[2]
+			if strings.HasPrefix(text, `"`) {
+				text = nginxUnquote(groups[3])
+			}
+			if rule == nil {
+				server.rules = append(server.rules, nginxRule{code: code, text: text})
+			} else {
+				rule.code, rule.text = code, text
+			}
+		case rule != nil && line == "}":
+			server.rules = append(server.rules, *rule)
+			rule = nil
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", i+1, line)
+		}
+	}
+	return c, nil
+}
+
+// serve answers a request as nginx would, choosing the first server with a name matching
+// host, or the default server, and returning from the first if block that applies
+func (c *nginxConfig) serve(host, path string) exportCase {
+	result := exportCase{Host: host, Path: path, Code: http.StatusNotFound}
+	var server *nginxServer
+	for i := range c.servers {
+		for _, name := range c.servers[i].names {
+			if server == nil && name.MatchString(host) {
+				server = &c.servers[i]
+			}
+		}
+	}
+	for i := range c.servers {
+		if server == nil && c.servers[i].defaultName {
+			server = &c.servers[i]
+		}
+	}
+	if server == nil {
+		return result
+	}
+
+	for _, r := range server.rules {
+		var groups []string
+		switch {
+		case len(r.variable) > 0:
+			if len(c.lookup(r.variable, path)) == 0 {
+				continue
+			}
+		case r.path != nil:
+			if groups = r.path.FindStringSubmatch(path); groups == nil {
+				continue
+			}
+		}
+
+		text := regexp.MustCompile(`\$(\w+)`).ReplaceAllStringFunc(r.text, func(v string) string {
+			if n, err := strconv.Atoi(v[1:]); err == nil {
+				return groups[n]
+			}
+			return c.lookup(v, path)
+		})
+		result.Code = r.code
+		if r.code == http.StatusGone {
+			result.Body = text
+		} else if r.code == http.StatusTemporaryRedirect {
+			result.Location = text
+		}
+		return result
+	}
+	return result
+}
+
+func (c *nginxConfig) lookup(variable, uri string) string {
+	for _, e := range c.maps[variable] {
+		if e.key.MatchString(uri) {
+			return e.value
+		}
+	}
+	return ""
+}
+
+// apacheConfig is rendered mod_rewrite rules read back, to answer requests the way Apache
+// would with them. Only what the export command writes is understood, and Go's regular
+// expressions stand in for PCRE.
+type apacheConfig struct {
+	goneMessage string
+	rules       []apacheRule
+}
+
+// apacheRule is a RewriteRule and the SERVER_NAME condition before it, if any
+type apacheRule struct {
+	host         *regexp.Regexp
+	pattern      *regexp.Regexp
+	substitution string
+	gone         bool
+}
+
+var (
+	apacheString      = `"((?:[^"\\]|\\.)*)"`
+	apacheErrorDoc    = regexp.MustCompile(`^ErrorDocument 410 ` + apacheString + `$`)
+	apacheHostCond    = regexp.MustCompile(`^RewriteCond %\{SERVER_NAME\} ` + apacheString + ` \[NC\]$`)
+	apacheRedirect    = regexp.MustCompile(`^RewriteRule ` + apacheString + ` ` + apacheString + ` \[R=307,L,NE\]$`)
+	apacheGone        = regexp.MustCompile(`^RewriteRule ` + apacheString + ` - \[G,L\]$`)
+	apacheSubstituted = regexp.MustCompile(`\\(.)|\$([0-9])`)
+)
+
+func apacheUnquote(s string) string {
+	return strings.ReplaceAll(s, `\"`, `"`)
+}
+
+// parseApache reads back rules written by the Apache export
+func parseApache(conf string) (*apacheConfig, error) {
+	c := &apacheConfig{}
+	var host *regexp.Regexp
+	for i, line := range strings.Split(conf, "\n") {
+		if len(line) == 0 || strings.HasPrefix(line, "#") || line == "RewriteEngine On" {
+			continue
+		}
+		var err error
+		if groups := apacheErrorDoc.FindStringSubmatch(line); groups != nil {
+			c.goneMessage = apacheUnquote(groups[1])
+		} else if groups := apacheHostCond.FindStringSubmatch(line); groups != nil {
+			host, err = regexp.Compile("(?i)" + apacheUnquote(groups[1]))
+		} else if groups := apacheRedirect.FindStringSubmatch(line); groups != nil {
+			r := apacheRule{host: host, substitution: apacheUnquote(groups[2])}
+			r.pattern, err = regexp.Compile(apacheUnquote(groups[1]))
+			c.rules, host = append(c.rules, r), nil
+		} else if groups := apacheGone.FindStringSubmatch(line); groups != nil {
+			r := apacheRule{host: host, gone: true}
+			r.pattern, err = regexp.Compile(apacheUnquote(groups[1]))
+			c.rules, host = append(c.rules, r), nil
+		} else {
+			return nil, fmt.Errorf("line %d: unexpected %q", i+1, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return c, nil
+}
+
+// serve answers a request as Apache would, applying the first rule whose condition and
+// pattern match
+func (c *apacheConfig) serve(host, path string) exportCase {
+	result := exportCase{Host: host, Path: path, Code: http.StatusNotFound}
+	for _, r := range c.rules {
+		if r.host != nil && !r.host.MatchString(host) {
+			continue
+		}
+		groups := r.pattern.FindStringSubmatch(path)
+		if groups == nil {
+			continue
+		}
+		if r.gone {
+			result.Code, result.Body = http.StatusGone, c.goneMessage
+			return result
+		}
+		result.Code = http.StatusTemporaryRedirect
+		result.Location = apacheSubstituted.ReplaceAllStringFunc(r.substitution, func(s string) string {
+			if s[0] == '\\' {
+				return s[1:]
+			}
+			n, _ := strconv.Atoi(s[1:])
+			return groups[n]
+		})
+		return result
+	}
+	return result
+}
+
+func TestExportConformance(t *testing.T) {
+	cases := exportCorpus(t)
+	m, err := newExportModel(defaultRules(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given the built-in rules exported", t, func() {
+		So(m.warnings, ShouldBeEmpty)
+
+		Convey("Then the nginx configuration answers the corpus as the router does", func() {
+			var out bytes.Buffer
+			So(m.nginx(&out), ShouldBeNil)
+			conf, err := parseNginx(out.String())
+			So(err, ShouldBeNil)
+			for _, c := range cases {
+				So(conf.serve(c.Host, c.Path), ShouldResemble, c)
+			}
+		})
+
+		Convey("Then the Apache rewrite rules answer the corpus as the router does", func() {
+			var out bytes.Buffer
+			So(m.apache(&out), ShouldBeNil)
+			conf, err := parseApache(out.String())
+			So(err, ShouldBeNil)
+			for _, c := range cases {
+				So(conf.serve(c.Host, c.Path), ShouldResemble, c)
+			}
+		})
+
+		Convey("Then the CloudFront Function answers the corpus as the router does", func() {
+			node, err := exec.LookPath("node")
+			if err != nil {
+				SkipSo("node isn't installed")
+				return
+			}
+
+			var script bytes.Buffer
+			So(m.cloudfront(&script), ShouldBeNil)
+			script.WriteString(`
+var cases = JSON.parse(require("fs").readFileSync(process.argv[2], "utf8"));
+console.log(JSON.stringify(cases.map(function (c) {
+  var r = handler({request: {uri: c.path, headers: {host: {value: c.host}}}});
+  return {
+    host: c.host,
+    path: c.path,
+    code: r.statusCode,
+    location: r.headers && r.headers.location ? r.headers.location.value : "",
+    body: r.body ? r.body.data : ""
+  };
+})));
+`)
+			dir := t.TempDir()
+			scriptFile, casesFile := filepath.Join(dir, "function.js"), filepath.Join(dir, "cases.json")
+			So(os.WriteFile(scriptFile, script.Bytes(), 0o600), ShouldBeNil)
+			casesJSON, _ := json.Marshal(cases)
+			So(os.WriteFile(casesFile, casesJSON, 0o600), ShouldBeNil)
+
+			out, err := exec.Command(node, scriptFile, casesFile).Output()
+			So(err, ShouldBeNil)
+			var results []exportCase
+			So(json.Unmarshal(out, &results), ShouldBeNil)
+			So(results, ShouldResemble, cases)
+		})
+	})
+}
+
+func TestExport(t *testing.T) {
+	Convey("Given a rule set with routes edge servers can't reproduce", t, func() {
+		expires := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		rs := &ruleSet{
+			Version: "test",
+			Aliases: map[string]string{"old.example.com": "example.com"},
+			Sites: []site{{
+				Name:          "example",
+				Hosts:         []string{"example.com"},
+				HostResponses: map[string]responses{"example.com": {GoneMessage: "Gone from example.com"}},
+				Routes: []route{
+					{ID: "browser", Path: "/api/{uri:.*}", Handler: "landing", When: &conditions{Clients: []string{clientBrowser}}},
+					{ID: "computed", Path: "/area/{code}", Destination: "'https://www.ons.gov.uk/' + vars.code"},
+					{ID: "expired", Path: "/old/{uri:.*}", Handler: "landing", ExpiresAt: &expires},
+					{ID: "api", Path: "/api/{uri:.*}", Handler: "gone"},
+				},
+			}},
+		}
+		m, err := newExportModel(rs, time.Now())
+		So(err, ShouldBeNil)
+
+		Convey("Then they are left out with a warning", func() {
+			So(m.warnings, ShouldResemble, []string{
+				"site example: route browser has conditions and isn't exported",
+				"site example: route computed has a destination expression and isn't exported",
+				"site example: route expired isn't in effect and isn't exported",
+			})
+			So(m.sites[1].rules, ShouldHaveLength, 1)
+		})
+
+		Convey("Then host responses and aliases are exported", func() {
+			So(m.sites[0].hosts, ShouldResemble, []string{`^example\.com$`})
+			So(m.sites[0].rules[0].goneMessage, ShouldEqual, "Gone from example.com")
+			So(m.sites[1].hosts, ShouldResemble, []string{`^example\.com$`, `^old\.example\.com$`})
+		})
+	})
+
+	Convey("Given the built-in rules", t, func() {
+		export := func(format string) (string, error) {
+			var stdout, stderr bytes.Buffer
+			err := exportCommand([]string{"-format", format}, &stdout, &stderr)
+			return stdout.String(), err
+		}
+
+		Convey("Then nginx server blocks are rendered with a map of visual articles", func() {
+			out, err := export(exportNginx)
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, `server_name "~^web\\.ons\\.gov\\.uk$";`)
+			So(out, ShouldContainSubstring, `"~^/baby-names(?:/.*)?$" "`+visualRedirects["baby-names"]+`";`)
+			So(out, ShouldContainSubstring, "    if ($uri ~ \"^/HTMLDocs/(.*)$\") {\n        return 307 \"https://www.ons.gov.uk/visualisations/nesscontent/$1\";\n    }\n")
+			So(out, ShouldContainSubstring, "listen 80 default_server;")
+		})
+
+		Convey("Then Apache rewrite rules are rendered", func() {
+			out, err := export(exportApache)
+			So(err, ShouldBeNil)
+			So(out, ShouldContainSubstring, `RewriteCond %{SERVER_NAME} "(?:^web\.ons\.gov\.uk$)" [NC]`+"\n"+`RewriteRule "^/ons/api/(.*)$" - [G,L]`)
+			So(out, ShouldContainSubstring, `RewriteRule "^/wp-content/uploads/(.*)$" "https://static.ons.gov.uk/visual/$1" [R=307,L,NE]`)
+			So(out, ShouldContainSubstring, "ErrorDocument 410 "+strconv.Quote(apiResponse))
+		})
+
+		Convey("Then unknown formats are rejected", func() {
+			_, err := export("iis")
+			So(err, ShouldNotBeNil)
+			So(strings.Contains(err.Error(), "iis"), ShouldBeTrue)
+		})
+	})
+}
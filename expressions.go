@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/gorilla/mux"
+)
+
+// exprEnv is the request as seen by rule expressions. Query parameters and headers
+// hold their first value, and headers are keyed by their canonical name, e.g.
+// headers["User-Agent"].
+type exprEnv struct {
+	Method   string            `expr:"method"`
+	Scheme   string            `expr:"scheme"`
+	Host     string            `expr:"host"`
+	Path     string            `expr:"path"`
+	Segments []string          `expr:"segments"`
+	Vars     map[string]string `expr:"vars"`
+	Query    map[string]string `expr:"query"`
+	Headers  map[string]string `expr:"headers"`
+	Client   string            `expr:"client"`
+	Language string            `expr:"language"`
+	Now      time.Time         `expr:"now"`
+}
+
+// exprFunctions are the functions available to rule expressions, in addition to the
+// expr builtins
+var exprFunctions = []expr.Option{
+	expr.Function("pathEscape", func(params ...interface{}) (interface{}, error) {
+		return url.PathEscape(params[0].(string)), nil
+	}, new(func(string) string)),
+	expr.Function("queryEscape", func(params ...interface{}) (interface{}, error) {
+		return url.QueryEscape(params[0].(string)), nil
+	}, new(func(string) string)),
+}
+
+// compileCondition compiles and type checks an expression deciding whether a route applies
+func compileCondition(src string) (*vm.Program, error) {
+	return compileExpr(src, expr.AsBool())
+}
+
+// compileDestination compiles and type checks an expression computing a redirect destination
+func compileDestination(src string) (*vm.Program, error) {
+	return compileExpr(src, expr.AsKind(reflect.String))
+}
+
+func compileExpr(src string, result expr.Option) (*vm.Program, error) {
+	opts := append([]expr.Option{expr.Env(exprEnv{}), result}, exprFunctions...)
+	program, err := expr.Compile(src, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", src, err)
+	}
+	return program, nil
+}
+
+// newExprEnv returns the environment rule expressions are evaluated in for req, with
+// the given path template variables
+func newExprEnv(req *http.Request, vars map[string]string) exprEnv {
+	env := exprEnv{
+		Method:   req.Method,
+		Scheme:   requestScheme(req),
+		Host:     normaliseHost(req.Host),
+		Path:     req.URL.Path,
+		Vars:     vars,
+		Query:    map[string]string{},
+		Headers:  make(map[string]string, len(req.Header)),
+		Client:   clientFor(req),
+		Language: languageFor(req),
+		Now:      time.Now().UTC(),
+	}
+	if env.Vars == nil {
+		env.Vars = map[string]string{}
+	}
+	for _, segment := range strings.Split(req.URL.Path, "/") {
+		if len(segment) > 0 {
+			env.Segments = append(env.Segments, segment)
+		}
+	}
+	for name, values := range req.URL.Query() {
+		env.Query[name] = values[0]
+	}
+	for name, values := range req.Header {
+		env.Headers[name] = values[0]
+	}
+	return env
+}
+
+// exprCondition matches requests for which a compiled condition expression is true
+type exprCondition struct {
+	src     string
+	program *vm.Program
+}
+
+func newExprCondition(src string) (*exprCondition, error) {
+	program, err := compileCondition(src)
+	if err != nil {
+		return nil, err
+	}
+	return &exprCondition{src: src, program: program}, nil
+}
+
+// match implements mux.MatcherFunc, taking the path variables from m, which the route
+// matcher fills in from the route's path template before checking its conditions.
+// Expressions failing at request time don't match.
+func (c *exprCondition) match(req *http.Request, m *mux.RouteMatch) bool {
+	var vars map[string]string
+	if m != nil {
+		vars = m.Vars
+	}
+
+	out, err := expr.Run(c.program, newExprEnv(req, vars))
+	if err != nil {
+		if !shadowing(req) {
+			log.Error(req.Context(), "failed to evaluate rule condition", err, log.Data{"expression": c.src})
+		}
+		return false
+	}
+	return out.(bool)
+}
+
+// destinationHandler redirects to the destination computed by a compiled expression.
+// Destinations are checked against the destination policy like any other redirect, and
+// requests whose destination can't be computed are sent to the landing page.
+func destinationHandler(src string, program *vm.Program) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		out, err := expr.Run(program, newExprEnv(req, mux.Vars(req)))
+		if err != nil {
+			if !shadowing(req) {
+				log.Error(req.Context(), "failed to evaluate rule destination", err, log.Data{"expression": src})
+			}
+			defaultHandler(w, req)
+			return
+		}
+		redirect(w, req, "redirecting to rule destination", out.(string), log.Data{})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestExpressionRoutes(t *testing.T) {
+	Convey("Given routes using condition and destination expressions", t, func() {
+		rules := defaultRules()
+		rules.Sites[0].Routes = append([]route{{
+			ID:          "ness-area",
+			Path:        "/HTMLDocs/area/{code}",
+			If:          `vars.code matches "^[EWSN][0-9]{8}$" && method == "GET"`,
+			Destination: `"https://www.ons.gov.uk/explore-local-statistics/areas/" + pathEscape(vars.code)`,
+		}, {
+			ID:          "ness-search",
+			Path:        "/dissemination/LeadKeywordSearch.do",
+			If:          `"keyword" in query && client != "bot"`,
+			Destination: `"https://www.ons.gov.uk/search?q=" + queryEscape(query.keyword) + (language == "cy" ? "&lang=cy" : "")`,
+		}, {
+			ID:          "ness-segments",
+			Path:        "/legacy/{rest:.*}",
+			Destination: `"https://www.ons.gov.uk/" + join(segments[1:], "-")`,
+		}, {
+			ID:          "ness-broken",
+			Path:        "/broken/{uri:.*}",
+			Destination: `"https://" + headers["X-Target"]`,
+		}}, rules.Sites[0].Routes...)
+		router, err := newTestRouter(healthcheck.HealthCheck{}, rules)
+		So(err, ShouldBeNil)
+
+		serve := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, target, nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+		host := "http://neighbourhood.statistics.gov.uk"
+
+		Convey("Then destinations are computed from path variables", func() {
+			w := serve("GET", host+"/HTMLDocs/area/E09000033", nil)
+			So(w.Code, ShouldEqual, redir)
+			So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/explore-local-statistics/areas/E09000033")
+		})
+
+		Convey("Then requests failing the condition fall through to the next route", func() {
+			w := serve("GET", host+"/HTMLDocs/area/london", nil)
+			So(w.Code, ShouldEqual, redir)
+			So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/visualisations/nesscontent/area/london")
+			So(serve("POST", host+"/HTMLDocs/area/E09000033", nil).Header().Get("Location"), ShouldStartWith, "https://www.ons.gov.uk/visualisations/")
+		})
+
+		Convey("Then destinations are computed from the query, client and language", func() {
+			w := serve("GET", host+"/dissemination/LeadKeywordSearch.do?keyword=house+prices", http.Header{"Accept-Language": {"cy"}})
+			So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/search?q=house+prices&lang=cy")
+
+			w = serve("GET", host+"/dissemination/LeadKeywordSearch.do?keyword=x", http.Header{"User-Agent": {"Googlebot/2.1"}})
+			So(w.Header().Get("Location"), ShouldNotContainSubstring, "search")
+		})
+
+		Convey("Then destinations are computed from path segments", func() {
+			So(serve("GET", host+"/legacy/a/b", nil).Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/a-b")
+		})
+
+		Convey("Then computed destinations are checked against the destination policy", func() {
+			So(serve("GET", host+"/broken/x", http.Header{"X-Target": {"evil.example.com/"}}).Code, ShouldEqual, http.StatusBadRequest)
+			So(serve("GET", host+"/broken/x", http.Header{"X-Target": {"www.ons.gov.uk/census"}}).Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/census")
+		})
+	})
+
+	Convey("Expressions are type checked when rules are validated", t, func() {
+		for _, r := range []route{
+			{ID: "syntax", Path: "/a", Handler: "landing", If: `path ==`},
+			{ID: "not-bool", Path: "/a", Handler: "landing", If: `path`},
+			{ID: "unknown-var", Path: "/a", Handler: "landing", If: `pth == "/a"`},
+			{ID: "not-string", Path: "/a", Destination: `len(path)`},
+			{ID: "both", Path: "/a", Handler: "landing", Destination: `"https://www.ons.gov.uk"`},
+		} {
+			rules := defaultRules()
+			rules.Sites[0].Routes = []route{r}
+			So(rules.validate(), ShouldNotBeNil)
+		}
+	})
+}
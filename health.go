@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+// draining is set once shutdown has been requested, so load balancers stop routing to this instance
+var draining atomic.Bool
+
+// healthHandler serves the health check, reporting the service as critical while draining
+func healthHandler(hc *healthcheck.HealthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !draining.Load() {
+			hc.Handler(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := json.NewEncoder(w).Encode(map[string]string{
+			"status":  healthcheck.StatusCritical,
+			"message": "shutting down",
+		}); err != nil {
+			log.Error(req.Context(), "error writing response", err)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-legacy-redirector/config"
+)
+
+// Formats the import command reads mappings from
+const (
+	importAuto  = "auto"
+	importCSV   = "csv"
+	importTSV   = "tsv"
+	importNginx = "nginx"
+)
+
+// Outcomes of importing a mapping, as reported by the import command
+const (
+	importAdded     = "added"
+	importChanged   = "changed"
+	importUnchanged = "unchanged"
+	importConflict  = "conflict"
+	importInvalid   = "invalid"
+)
+
+// errImportProblems is returned by the import command when mappings conflicted with
+// existing ones or couldn't be read, so that it exits with a distinct status
+var errImportProblems = errors.New("some mappings were not imported")
+
+// Column headings recognised in spreadsheets, compared case insensitively
+var (
+	slugHeadings = []string{"slug", "article", "from", "source", "old", "old url", "legacy url"}
+	destHeadings = []string{"destination", "dest", "to", "target", "new", "new url", "redirect", "url"}
+)
+
+// mapping is a slug and destination read from an import file. Err is set if the row
+// couldn't be read or normalised.
+type mapping struct {
+	slug   string
+	dest   string
+	source string
+	err    error
+}
+
+// readMappings reads the mappings in b, named name in reports, in the given format. Rows
+// that can't be read are returned with their error, so they can be reported.
+func readMappings(b []byte, name, format string) ([]mapping, error) {
+	b = bytes.TrimPrefix(b, []byte("\ufeff"))
+	if format == importAuto {
+		format = detectImportFormat(b, name)
+	}
+
+	switch format {
+	case importCSV, importTSV:
+		return readSpreadsheet(b, name, format)
+	case importNginx:
+		return readNginxMap(b, name), nil
+	default:
+		return nil, fmt.Errorf("unknown import format %q", format)
+	}
+}
+
+// detectImportFormat guesses the format of b from its file extension, or if that's not
+// conclusive, its first line
+func detectImportFormat(b []byte, name string) string {
+	switch strings.ToLower(filepath.Ext(strings.TrimSuffix(name, ".gz"))) {
+	case ".csv":
+		return importCSV
+	case ".tsv", ".tab":
+		return importTSV
+	case ".conf", ".map", ".nginx":
+		return importNginx
+	}
+
+	first, _, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	first = strings.TrimSpace(first)
+	switch {
+	case strings.HasPrefix(first, "map ") || strings.HasSuffix(first, ";") || strings.HasPrefix(first, "#"):
+		return importNginx
+	case strings.Contains(first, "\t"):
+		return importTSV
+	default:
+		return importCSV
+	}
+}
+
+// readSpreadsheet reads CSV or TSV with a slug and destination column. If the first row
+// has recognised headings they pick the columns, otherwise the first two are used.
+func readSpreadsheet(b []byte, name, format string) ([]mapping, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	if format == importTSV {
+		r.Comma = '\t'
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	slugCol, destCol, first := 0, 1, 0
+	if len(records) > 0 {
+		if s, d := headingIndex(records[0], slugHeadings), headingIndex(records[0], destHeadings); s >= 0 && d >= 0 && s != d {
+			slugCol, destCol, first = s, d, 1
+		}
+	}
+
+	var mappings []mapping
+	for i := first; i < len(records); i++ {
+		record := records[i]
+		if len(strings.Join(record, "")) == 0 {
+			continue
+		}
+		m := mapping{source: fmt.Sprintf("%s:%d", name, i+1)}
+		if len(record) <= slugCol || len(record) <= destCol {
+			m.err = errors.New("row doesn't have a slug and destination")
+		} else {
+			m.slug, m.dest = record[slugCol], record[destCol]
+		}
+		mappings = append(mappings, m.normalise())
+	}
+	return mappings, nil
+}
+
+// headingIndex returns the index of the first heading in record matching one of names,
+// preferring earlier names, or -1
+func headingIndex(record []string, names []string) int {
+	for _, name := range names {
+		for i, heading := range record {
+			if strings.EqualFold(strings.TrimSpace(heading), name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// nginxArticleKey matches the regular expression keys the export command writes for articles
+var nginxArticleKey = regexp.MustCompile(`^~\*?\^/((?:[^/\\.*+?()\[\]{}|^$]|\\.)+)(?:\(\?:/\.\*\)\?|/\?)?\$?$`)
+
+// readNginxMap reads the entries of nginx map blocks. Keys may be paths, URLs or
+// regular expressions of the form the export command writes.
+func readNginxMap(b []byte, name string) []mapping {
+	var mappings []mapping
+	for i, line := range strings.Split(string(b), "\n") {
+		tokens, err := nginxTokens(line)
+		if len(tokens) == 0 && err == nil {
+			continue
+		}
+		m := mapping{source: fmt.Sprintf("%s:%d", name, i+1), err: err}
+		if err == nil {
+			switch tokens[0] {
+			case "map", "}", "default", "hostnames", "volatile", "include":
+				continue
+			}
+			if len(tokens) != 2 {
+				m.err = errors.New("map entry must have a key and a value")
+			} else {
+				m.slug, m.dest = tokens[0], tokens[1]
+				if strings.HasPrefix(m.slug, "~") {
+					if groups := nginxArticleKey.FindStringSubmatch(m.slug); groups != nil {
+						m.slug = regexp.MustCompile(`\\(.)`).ReplaceAllString(groups[1], "$1")
+					} else {
+						m.err = fmt.Errorf("regular expression %s isn't a single article", m.slug)
+					}
+				}
+			}
+		}
+		mappings = append(mappings, m.normalise())
+	}
+	return mappings
+}
+
+// nginxTokens splits a line of an nginx map block into its words, without quotes,
+// comments or the terminating semicolon
+func nginxTokens(line string) ([]string, error) {
+	var tokens []string
+	var token strings.Builder
+	var quote rune
+	inToken := false
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			token.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote, inToken = c, true
+		case c == '#':
+			if inToken {
+				tokens = append(tokens, token.String())
+			}
+			return tokens, nil
+		case c == ' ' || c == '\t' || c == '\r' || c == ';' || c == '{':
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(c)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+	return tokens, nil
+}
+
+// normalise reduces the slug to a lower case path segment, accepting a path or a legacy
+// URL, and the destination to the canonical form the destination policy allows
+func (m mapping) normalise() mapping {
+	if m.err != nil {
+		return m
+	}
+	var err error
+	if m.slug, err = normaliseSlug(m.slug); err != nil {
+		m.err = fmt.Errorf("slug %q: %w", m.slug, err)
+		return m
+	}
+	if m.dest, err = normaliseDestination(m.dest); err != nil {
+		m.err = fmt.Errorf("destination %q: %w", m.dest, err)
+	}
+	return m
+}
+
+func normaliseSlug(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if first, _, _ := strings.Cut(s, "/"); !strings.Contains(s, "://") && strings.Contains(first, ".") {
+		s = "//" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s, err
+	}
+
+	slug := strings.ToLower(strings.Trim(u.Path, "/"))
+	if len(slug) == 0 {
+		return s, errors.New("is empty")
+	}
+	if strings.Contains(slug, "/") {
+		return s, errors.New("isn't a single path segment")
+	}
+	return slug, nil
+}
+
+func normaliseDestination(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "//"):
+		s = "https:" + s
+	case !strings.Contains(s, "://"):
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s, errUnparsableAddress
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return destinations.check(u.String())
+}
+
+// importResult is what happened to an imported mapping, and the destination its slug
+// had before
+type importResult struct {
+	outcome  string
+	existing string
+}
+
+// importMappings merges mappings into redirects in order. Conflicting mappings replace
+// the existing destination only if overwrite is set.
+func importMappings(redirects map[string]string, mappings []mapping, overwrite bool) []importResult {
+	results := make([]importResult, len(mappings))
+	for i, m := range mappings {
+		if m.err != nil {
+			results[i].outcome = importInvalid
+			continue
+		}
+		existing, ok := redirects[m.slug]
+		results[i].existing = existing
+		switch {
+		case !ok:
+			results[i].outcome = importAdded
+			redirects[m.slug] = m.dest
+		case existing == m.dest:
+			results[i].outcome = importUnchanged
+		case overwrite:
+			results[i].outcome = importChanged
+			redirects[m.slug] = m.dest
+		default:
+			results[i].outcome = importConflict
+		}
+	}
+	return results
+}
+
+// importCommand reads redirect mappings from spreadsheets and nginx maps into a site's
+// redirects in a rules file, or the current rules in RULES_STORE, and writes a CSV report
+// of what happened to each mapping
+func importCommand(cfg *config.Config, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	rulesFile := fs.String("rules", cfg.RulesFile, "rules file to import into, created from the built-in rules if it doesn't exist")
+	addr := fs.String("addr", cfg.AdminBindAddr, "admin listener of the redirector to push the rules to, if RULES_STORE is set")
+	siteName := fs.String("site", "visual", "site whose redirects are imported into")
+	format := fs.String("format", importAuto, "input format: auto, csv, tsv or nginx")
+	version := fs.String("version", "", "version to give the imported rules")
+	author := fs.String("author", os.Getenv("USER"), "who is importing the mappings into a rules file, for the audit log")
+	overwrite := fs.Bool("overwrite", false, "replace the destinations of existing slugs that conflict")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without writing the rules file")
+	keyFile := fs.String("key", "", "PEM encoded ed25519 private key to sign the imported rules with, required if they were signed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return flag.ErrHelp
+	}
+	// With a rule store the running service ignores RULES_FILE, so the rules are pushed
+	// to its store instead, unless a file is asked for explicitly
+	toStore := len(cfg.RulesStore) > 0
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "rules" {
+			toStore = false
+		}
+	})
+	if !toStore && len(*rulesFile) == 0 {
+		return errors.New("a rules file must be given with -rules or RULES_FILE")
+	}
+
+	destinations = newDestinationPolicy(cfg.AllowedRedirectHosts, cfg.AllowedRedirectSchemes)
+	if len(cfg.AuditLogFile) > 0 {
+		var err error
+		if audit, err = newAuditLog(cfg.AuditLogFile, cfg.AuditLogKey); err != nil {
+			return err
+		}
+	}
+
+	var key ed25519.PrivateKey
+	if len(*keyFile) > 0 {
+		var err error
+		if key, err = readSigningKey(*keyFile); err != nil {
+			return err
+		}
+	}
+
+	var rules *ruleSet
+	var current *storedRules
+	var bundle json.RawMessage
+	var err error
+	if toStore {
+		rules, current, err = fetchStoredRules(cfg, *addr)
+		if err == nil {
+			bundle = current.Bundle
+		}
+	} else if rules, bundle, err = readRules(*rulesFile); errors.Is(err, os.ErrNotExist) {
+		rules, err = defaultRules(), nil
+	}
+	if err != nil {
+		return err
+	}
+	// Writing signed rules back unsigned would stop them loading if signatures are
+	// required, and silently drop the signature if not
+	if len(bundle) > 0 && key == nil && !*dryRun {
+		return errors.New("the rules are signed, so -key must be given to sign the imported rules")
+	}
+	var target *site
+	for i := range rules.Sites {
+		if rules.Sites[i].Name == *siteName {
+			target = &rules.Sites[i]
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("rules have no site %q", *siteName)
+	}
+
+	redirects := make(map[string]string, len(target.articleRedirects()))
+	for slug, dest := range target.articleRedirects() {
+		redirects[slug] = dest
+	}
+
+	var mappings []mapping
+	for _, path := range fs.Args() {
+		f, err := openLog(path)
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		read, err := readMappings(b, path, *format)
+		if err != nil {
+			return err
+		}
+		mappings = append(mappings, read...)
+	}
+
+	results := importMappings(redirects, mappings, *overwrite)
+	counts := map[string]int{}
+	out := csv.NewWriter(stdout)
+	out.Write([]string{"source", "slug", "outcome", "existing", "imported", "error"})
+	for i, m := range mappings {
+		counts[results[i].outcome]++
+		var msg string
+		if m.err != nil {
+			msg = m.err.Error()
+		}
+		out.Write([]string{m.source, m.slug, results[i].outcome, results[i].existing, m.dest, msg})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "%d mappings: %d added, %d changed, %d unchanged, %d conflicts, %d invalid\n",
+		len(mappings), counts[importAdded], counts[importChanged], counts[importUnchanged], counts[importConflict], counts[importInvalid])
+
+	if !*dryRun && counts[importAdded]+counts[importChanged] > 0 {
+		before := *rules
+		before.Sites = append([]site(nil), rules.Sites...)
+		target.Redirects = redirects
+		if len(*version) > 0 {
+			rules.Version = *version
+		}
+		source := "import:" + strings.Join(fs.Args(), ",")
+		if toStore {
+			// The service audits the push itself, by the holder of ADMIN_TOKEN
+			stored, err := pushStoredRules(cfg, *addr, rules, key, current.Version, source)
+			if err != nil {
+				return fmt.Errorf("imported rules not pushed to %s: %w", *addr, err)
+			}
+			fmt.Fprintf(stderr, "pushed to the rule store as version %d\n", stored.Version)
+		} else {
+			if err := writeRules(*rulesFile, rules, key); err != nil {
+				return err
+			}
+			err := audit.record(auditRecord{
+				Actor:   *author,
+				Action:  auditImport,
+				Source:  source,
+				Version: rules.Version,
+				Changes: diffRules(&before, rules),
+			})
+			if err != nil {
+				return fmt.Errorf("rules written but not audited: %w", err)
+			}
+		}
+	}
+
+	if counts[importConflict]+counts[importInvalid] > 0 {
+		return errImportProblems
+	}
+	return nil
+}
+
+// fetchStoredRules returns the current rules in the store of the redirector whose admin
+// listener is at addr, and the version they are
+func fetchStoredRules(cfg *config.Config, addr string) (*ruleSet, *storedRules, error) {
+	var b bytes.Buffer
+	if err := adminRequest(cfg, addr, http.MethodGet, "/rules/versions", url.Values{"format": {"json"}}, nil, &b); err != nil {
+		return nil, nil, err
+	}
+	var versions []storedRules
+	if err := json.Unmarshal(b.Bytes(), &versions); err != nil {
+		return nil, nil, err
+	}
+	if len(versions) == 0 {
+		return nil, nil, errors.New("the rule store is empty")
+	}
+
+	b.Reset()
+	path := fmt.Sprintf("/rules/versions/%d", versions[0].Version)
+	if err := adminRequest(cfg, addr, http.MethodGet, path, url.Values{"format": {"json"}}, nil, &b); err != nil {
+		return nil, nil, err
+	}
+	var stored storedRules
+	if err := json.Unmarshal(b.Bytes(), &stored); err != nil {
+		return nil, nil, err
+	}
+	var rs ruleSet
+	if err := json.Unmarshal(stored.Rules, &rs); err != nil {
+		return nil, nil, err
+	}
+	return &rs, &stored, nil
+}
+
+// pushStoredRules pushes rs, signed with key if it isn't nil, to the store of the
+// redirector whose admin listener is at addr as a new version, which it serves. The push
+// is refused if the current version is no longer parent, so changes made since the rules
+// were fetched aren't lost.
+func pushStoredRules(cfg *config.Config, addr string, rs *ruleSet, key ed25519.PrivateKey, parent uint64, message string) (*storedRules, error) {
+	body, err := marshalRules(rs, key)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	query := url.Values{"format": {"json"}, "message": {message}, "parent": {strconv.FormatUint(parent, 10)}}
+	if err := adminRequest(cfg, addr, http.MethodPost, "/rules/versions", query, bytes.NewReader(body), &b); err != nil {
+		return nil, err
+	}
+	var stored storedRules
+	if err := json.Unmarshal(b.Bytes(), &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// marshalRules validates rs and returns it as JSON, or as a bundle signed with key if
+// it isn't nil
+func marshalRules(rs *ruleSet, key ed25519.PrivateKey) ([]byte, error) {
+	if err := rs.validate(); err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(rs, "", "  ")
+	if err != nil || key == nil {
+		return b, err
+	}
+	bundle, err := signRules(b, key)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// writeRules validates rs and replaces the rules file at path with it, signed with key if
+// it isn't nil. The file is replaced by a rename so a reload never sees it partly written.
+func writeRules(path string, rs *ruleSet, key ed25519.PrivateKey) error {
+	b, err := marshalRules(rs, key)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-legacy-redirector/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReadMappings(t *testing.T) {
+	Convey("Given a spreadsheet exported as CSV with headings", t, func() {
+		csv := "\ufeffNotes,Old URL,New URL\n" +
+			"checked,https://visual.ons.gov.uk/Baby-Names/, https://WWW.ons.gov.uk/babynames\n" +
+			",,\n" +
+			"todo,visual.ons.gov.uk/gdp-and-me,www.ons.gov.uk/gdp\n" +
+			"bad,a/b,https://www.ons.gov.uk/x\n" +
+			"bad,evil,https://evil.com/\n"
+		mappings, err := readMappings([]byte(csv), "articles.csv", importAuto)
+		So(err, ShouldBeNil)
+
+		Convey("Then slugs and destinations are normalised", func() {
+			So(mappings, ShouldHaveLength, 4)
+			So(mappings[0], ShouldResemble, mapping{slug: "baby-names", dest: "https://www.ons.gov.uk/babynames", source: "articles.csv:2"})
+			So(mappings[1], ShouldResemble, mapping{slug: "gdp-and-me", dest: "https://www.ons.gov.uk/gdp", source: "articles.csv:4"})
+		})
+
+		Convey("Then rows that aren't single articles or allowed destinations are invalid", func() {
+			So(mappings[2].err, ShouldNotBeNil)
+			So(mappings[3].err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given TSV without headings", t, func() {
+		mappings, err := readMappings([]byte("a\thttps://www.ons.gov.uk/a\n/b/\thttps://www.ons.gov.uk/b\n"), "-", importAuto)
+		So(err, ShouldBeNil)
+		So(mappings, ShouldHaveLength, 2)
+		So(mappings[1].slug, ShouldEqual, "b")
+		So(mappings[1].err, ShouldBeNil)
+	})
+
+	Convey("Given an nginx map written by the export command", t, func() {
+		var out bytes.Buffer
+		m, err := newExportModel(defaultRules(), time.Now())
+		So(err, ShouldBeNil)
+		So(m.nginx(&out), ShouldBeNil)
+		block, _, _ := strings.Cut(out.String(), "\n}\n")
+
+		mappings, err := readMappings([]byte(block+"\n}\n"), "visual.conf", importAuto)
+		So(err, ShouldBeNil)
+
+		Convey("Then it reads back as the visual redirects", func() {
+			read := map[string]string{}
+			for _, m := range mappings {
+				So(m.err, ShouldBeNil)
+				read[m.slug] = m.dest
+			}
+			So(read, ShouldResemble, visualRedirects)
+		})
+	})
+
+	Convey("Given an nginx map with paths and unsupported entries", t, func() {
+		mappings, err := readMappings([]byte(`map $uri $new {
+    default "";
+    /a https://www.ons.gov.uk/a;  # moved
+    "~^/b[0-9]+$" https://www.ons.gov.uk/b;
+    /c;
+}`), "-", importNginx)
+		So(err, ShouldBeNil)
+		So(mappings, ShouldHaveLength, 3)
+		So(mappings[0].slug, ShouldEqual, "a")
+		So(mappings[0].err, ShouldBeNil)
+		So(mappings[1].err, ShouldNotBeNil)
+		So(mappings[2].err, ShouldNotBeNil)
+	})
+}
+
+func TestImportCommand(t *testing.T) {
+	cfg := &config.Config{
+		AllowedRedirectHosts:   []string{"www.ons.gov.uk", "webarchive.nationalarchives.gov.uk"},
+		AllowedRedirectSchemes: []string{"https", "http"},
+	}
+	defer func(policy *destinationPolicy) { destinations = policy }(destinations)
+
+	Convey("Given a spreadsheet of visual articles and no rules file", t, func() {
+		dir := t.TempDir()
+		rulesFile, input := filepath.Join(dir, "rules.json"), filepath.Join(dir, "articles.csv")
+		So(os.WriteFile(input, []byte("slug,destination\n"+
+			"new-article,https://www.ons.gov.uk/new\n"+
+			"baby-names,"+visualRedirects["baby-names"]+"\n"+
+			"gdp-and-me,https://www.ons.gov.uk/gdp\n"), 0o600), ShouldBeNil)
+
+		run := func(args ...string) (string, string, error) {
+			var stdout, stderr bytes.Buffer
+			err := importCommand(cfg, append([]string{"-rules", rulesFile}, args...), &stdout, &stderr)
+			return stdout.String(), stderr.String(), err
+		}
+
+		Convey("When the mappings are imported", func() {
+			stdout, stderr, err := run("-version", "2", input)
+
+			Convey("Then conflicts are reported and kept, and the rest written to the rules file", func() {
+				So(err, ShouldEqual, errImportProblems)
+				So(stderr, ShouldEqual, "3 mappings: 1 added, 0 changed, 1 unchanged, 1 conflicts, 0 invalid\n")
+				So(stdout, ShouldContainSubstring, input+":2,new-article,added,,https://www.ons.gov.uk/new,\n")
+				So(stdout, ShouldContainSubstring, input+":4,gdp-and-me,conflict,"+visualRedirects["gdp-and-me"]+",https://www.ons.gov.uk/gdp,\n")
+
+				rules, err := loadRules(rulesFile)
+				So(err, ShouldBeNil)
+				So(rules.Version, ShouldEqual, "2")
+				So(rules.Sites[3].Redirects["new-article"], ShouldEqual, "https://www.ons.gov.uk/new")
+				So(rules.Sites[3].Redirects["gdp-and-me"], ShouldEqual, visualRedirects["gdp-and-me"])
+				So(rules.Sites[3].Redirects, ShouldHaveLength, len(visualRedirects)+1)
+			})
+
+			Convey("Then conflicts replace existing mappings with -overwrite", func() {
+				_, stderr, err := run("-overwrite", input)
+				So(err, ShouldBeNil)
+				So(stderr, ShouldEqual, "3 mappings: 0 added, 1 changed, 2 unchanged, 0 conflicts, 0 invalid\n")
+				rules, err := loadRules(rulesFile)
+				So(err, ShouldBeNil)
+				So(rules.Sites[3].Redirects["gdp-and-me"], ShouldEqual, "https://www.ons.gov.uk/gdp")
+			})
+		})
+
+		Convey("When the import is a dry run", func() {
+			_, _, err := run("-dry-run", "-overwrite", input)
+			So(err, ShouldBeNil)
+
+			Convey("Then no rules file is written", func() {
+				_, err := os.Stat(rulesFile)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+		})
+
+		Convey("When an audit log is configured", func() {
+			audited := *cfg
+			audited.AuditLogFile, audited.AuditLogKey = filepath.Join(dir, "audit.log"), testAuditKey
+			defer func() { audit = nil }()
+			err := importCommand(&audited, []string{"-rules", rulesFile, "-author", "jo", input}, &bytes.Buffer{}, &bytes.Buffer{})
+			So(err, ShouldEqual, errImportProblems)
+
+			Convey("Then the import is audited with its changes", func() {
+				b, err := os.ReadFile(audited.AuditLogFile)
+				So(err, ShouldBeNil)
+				var rec auditRecord
+				So(json.Unmarshal(b, &rec), ShouldBeNil)
+				So(rec.Action, ShouldEqual, auditImport)
+				So(rec.Actor, ShouldEqual, "jo")
+				So(rec.Source, ShouldEqual, "import:"+input)
+				So(rec.Changes, ShouldResemble, []ruleChange{{Change: changeAdded, Path: "sites/visual/redirects/new-article", New: "https://www.ons.gov.uk/new"}})
+			})
+		})
+
+		// signed replaces the rules file with the built-in rules signed with a new key,
+		// returning the key file and its public key
+		signed := func() (string, string) {
+			keyFile := filepath.Join(dir, "key.pem")
+			var pub, bundle bytes.Buffer
+			So(signCommand([]string{"-generate", "-key", keyFile}, &pub, &bytes.Buffer{}), ShouldBeNil)
+			b, err := json.Marshal(defaultRules())
+			So(err, ShouldBeNil)
+			So(os.WriteFile(rulesFile, b, 0o600), ShouldBeNil)
+			So(signCommand([]string{"-key", keyFile, rulesFile}, &bundle, &bytes.Buffer{}), ShouldBeNil)
+			So(os.WriteFile(rulesFile, bundle.Bytes(), 0o600), ShouldBeNil)
+			return keyFile, strings.TrimSpace(pub.String())
+		}
+
+		Convey("When the rules file is signed", func() {
+			keyFile, publicKey := signed()
+			before, err := os.ReadFile(rulesFile)
+			So(err, ShouldBeNil)
+
+			Convey("Then the import is refused unless it can be signed again", func() {
+				_, _, err := run("-overwrite", input)
+				So(err, ShouldNotBeNil)
+				after, err := os.ReadFile(rulesFile)
+				So(err, ShouldBeNil)
+				So(string(after), ShouldEqual, string(before))
+			})
+
+			Convey("Then the imported rules are signed with -key", func() {
+				_, _, err := run("-overwrite", "-key", keyFile, input)
+				So(err, ShouldBeNil)
+				policy, err := newSignaturePolicy([]string{publicKey}, true)
+				So(err, ShouldBeNil)
+				b, err := os.ReadFile(rulesFile)
+				So(err, ShouldBeNil)
+				rules, err := policy.decode(b)
+				So(err, ShouldBeNil)
+				So(rules.Sites[3].Redirects["new-article"], ShouldEqual, "https://www.ons.gov.uk/new")
+			})
+		})
+
+		Convey("When the site doesn't exist", func() {
+			_, _, err := run("-site", "nope", input)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When the rules are served from a store", func() {
+			store, err := openRuleStore(filepath.Join(dir, "rules.db"))
+			So(err, ShouldBeNil)
+			defer store.Close()
+			_, err = seedRuleStore(store, "")
+			So(err, ShouldBeNil)
+			active := newActiveRules("")
+			active.store = store
+			So(active.reload(context.Background()), ShouldBeNil)
+			server := httptest.NewServer(getAdminRouter(adminTokens{"jo": "s3cret"}, active))
+			defer server.Close()
+
+			stored := *cfg
+			stored.RulesFile, stored.RulesStore, stored.AdminToken = rulesFile, "rules.db", "s3cret"
+			var stderr bytes.Buffer
+			err = importCommand(&stored, []string{"-addr", server.Listener.Addr().String(), "-overwrite", input}, &bytes.Buffer{}, &stderr)
+
+			Convey("Then the imported rules are pushed to the store and served", func() {
+				So(err, ShouldBeNil)
+				So(stderr.String(), ShouldEndWith, "pushed to the rule store as version 2\n")
+				current, err := store.current()
+				So(err, ShouldBeNil)
+				So(current.Author, ShouldEqual, "jo")
+				So(current.Message, ShouldEqual, "import:"+input)
+				So(active.status().Version, ShouldEqual, "2")
+
+				rules, err := current.ruleSet()
+				So(err, ShouldBeNil)
+				So(rules.Sites[3].Redirects["new-article"], ShouldEqual, "https://www.ons.gov.uk/new")
+				_, err = os.Stat(rulesFile)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+
+			Convey("Then the import fails if the store can't be changed", func() {
+				stored.AdminToken = "wrong"
+				err := importCommand(&stored, []string{"-addr", server.Listener.Addr().String(), "-overwrite", input}, &bytes.Buffer{}, &bytes.Buffer{})
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "401")
+			})
+		})
+
+		Convey("When the store's current rules are signed", func() {
+			keyFile, _ := signed()
+			store, err := openRuleStore(filepath.Join(dir, "signed.db"))
+			So(err, ShouldBeNil)
+			defer store.Close()
+			_, err = seedRuleStore(store, rulesFile)
+			So(err, ShouldBeNil)
+			active := newActiveRules("")
+			active.store = store
+			So(active.reload(context.Background()), ShouldBeNil)
+			server := httptest.NewServer(getAdminRouter(adminTokens{"jo": "s3cret"}, active))
+			defer server.Close()
+
+			stored := *cfg
+			stored.RulesStore, stored.AdminToken = "signed.db", "s3cret"
+			args := []string{"-addr", server.Listener.Addr().String(), "-overwrite", input}
+
+			Convey("Then the import is refused unless it can be signed again", func() {
+				err := importCommand(&stored, args, &bytes.Buffer{}, &bytes.Buffer{})
+				So(err, ShouldNotBeNil)
+				So(active.status().Version, ShouldEqual, "1")
+			})
+
+			Convey("Then the imported rules are pushed signed with -key", func() {
+				err := importCommand(&stored, append([]string{"-key", keyFile}, args...), &bytes.Buffer{}, &bytes.Buffer{})
+				So(err, ShouldBeNil)
+				current, err := store.current()
+				So(err, ShouldBeNil)
+				So(current.Version, ShouldEqual, 2)
+				So(current.Bundle, ShouldNotBeEmpty)
+			})
+		})
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	english = "en"
+	welsh   = "cy"
+)
+
+// catalogues holds the built-in responses for each supported language
+var catalogues = map[string]responses{
+	english: {
+		LandingPage: landingPage,
+		GoneMessage: apiResponse,
+	},
+	welsh: {
+		LandingPage: "https://cy.ons.gov.uk/help/localstatistics",
+		GoneMessage: "Nid yw'r gwasanaeth hwn ar gael mwyach. Ewch i https://cy.ons.gov.uk/help/localstatistics i gael rhagor o wybodaeth.",
+	},
+}
+
+// localisedLandingPages controls whether users are redirected to the landing page in their
+// language, rather than only having 410 messages translated. It is set in main from config.
+var localisedLandingPages = false
+
+// languageFor selects a supported language for the request, preferring a cy. host prefix
+// over the Accept-Language header and falling back to English
+func languageFor(req *http.Request) string {
+	if strings.HasPrefix(normaliseHost(req.Host), welsh+".") {
+		return welsh
+	}
+
+	type preference struct {
+		lang string
+		q    float64
+	}
+	var prefs []preference
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		lang, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := catalogues[lang]; !ok {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if q > 0 {
+			prefs = append(prefs, preference{lang, q})
+		}
+	}
+
+	if len(prefs) == 0 {
+		return english
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	return prefs[0].lang
+}
+
+// varyByLanguage tells caches that the response depends on the Accept-Language header,
+// unless the host decides the language
+func varyByLanguage(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(normaliseHost(req.Host), welsh+".") {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+}
+
+// localise returns r translated into lang, using the rule set's translations where
+// given and the built-in catalogue otherwise. A landing page set by the rules is only
+// replaced by a translation given with it, as the catalogue's is of the default page.
+func (r responses) localise(lang string) responses {
+	if lang == english {
+		return r
+	}
+
+	translated := r.Languages[lang].inherit(catalogues[lang])
+	r.GoneMessage = translated.GoneMessage
+	if localisedLandingPages && (len(r.Languages[lang].LandingPage) > 0 || r.LandingPage == catalogues[english].LandingPage) {
+		r.LandingPage = translated.LandingPage
+	}
+	return r
+}
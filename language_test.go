@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLanguageFor(t *testing.T) {
+	Convey("languageFor selects a supported language", t, func() {
+		lang := func(host, acceptLanguage string) string {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = host
+			req.Header.Set("Accept-Language", acceptLanguage)
+			return languageFor(req)
+		}
+
+		So(lang("neighbourhood.statistics.gov.uk", ""), ShouldEqual, english)
+		So(lang("neighbourhood.statistics.gov.uk", "fr-FR, de;q=0.8"), ShouldEqual, english)
+		So(lang("neighbourhood.statistics.gov.uk", "cy-GB"), ShouldEqual, welsh)
+		So(lang("neighbourhood.statistics.gov.uk", "en-GB;q=0.9, cy;q=0.8"), ShouldEqual, english)
+		So(lang("neighbourhood.statistics.gov.uk", "en-GB;q=0.5, CY;q=0.8"), ShouldEqual, welsh)
+		So(lang("neighbourhood.statistics.gov.uk", "cy;q=0"), ShouldEqual, english)
+		So(lang("cy.neighbourhood.statistics.gov.uk", "en-GB"), ShouldEqual, welsh)
+	})
+}
+
+func TestWelshResponses(t *testing.T) {
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	hc := healthcheck.New(versionInfo, time.Second*10, time.Minute)
+	router, err := newTestRouter(hc, defaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(url, acceptLanguage string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	Convey("Given a client that prefers Welsh", t, func() {
+		Convey("Then 410 bodies are in Welsh", func() {
+			w := serve("https://web.ons.gov.uk/ons/api/a", "cy")
+			So(w.Code, ShouldEqual, 410)
+			So(w.Body.String(), ShouldEqual, catalogues[welsh].GoneMessage)
+			So(w.Header().Get("Content-Language"), ShouldEqual, welsh)
+			So(w.Header().Get("Vary"), ShouldEqual, "Accept-Language")
+		})
+
+		Convey("Then the English landing page is used by default", func() {
+			So(serve("https://web.ons.gov.uk/", "cy").Header().Get("Location"), ShouldEqual, landingPage)
+		})
+
+		Convey("Then the Welsh landing page is used when localised landing pages are enabled", func() {
+			localisedLandingPages = true
+			Reset(func() { localisedLandingPages = false })
+			w := serve("https://web.ons.gov.uk/", "cy")
+			So(w.Header().Get("Location"), ShouldEqual, catalogues[welsh].LandingPage)
+			So(w.Header().Get("Vary"), ShouldEqual, "Accept-Language")
+		})
+	})
+
+	Convey("Given a Welsh host", t, func() {
+		Convey("Then responses don't vary by Accept-Language", func() {
+			w := serve("https://cy.neighbourhood.statistics.gov.uk/NDE2/a", "en")
+			So(w.Body.String(), ShouldEqual, catalogues[welsh].GoneMessage)
+			So(w.Header().Values("Vary"), ShouldBeEmpty)
+		})
+	})
+
+	Convey("Given sites with their own landing pages and localised landing pages enabled", t, func() {
+		localisedLandingPages = true
+		defer func() { localisedLandingPages = false }()
+
+		rules := defaultRules()
+		rules.Languages = map[string]responses{welsh: {LandingPage: "https://cy.ons.gov.uk/help"}}
+		rules.Sites[1].Hosts = append(rules.Sites[1].Hosts, "wda.ons.gov.uk")
+		rules.Sites[1].LandingPage = "https://www.ons.gov.uk/wda"
+		rules.Sites[1].HostResponses = map[string]responses{"web.ons.gov.uk": {
+			LandingPage: "https://www.ons.gov.uk/web",
+			Languages:   map[string]responses{welsh: {LandingPage: "https://cy.ons.gov.uk/web"}},
+		}}
+		So(rules.validate(), ShouldBeNil)
+		router, err := newTestRouter(hc, rules)
+		So(err, ShouldBeNil)
+
+		location := func(url string) string {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", url, nil)
+			req.Header.Set("Accept-Language", "cy")
+			router.ServeHTTP(w, req)
+			return w.Header().Get("Location")
+		}
+
+		Convey("Then a site's page is kept for Welsh speakers without a Welsh page of its own", func() {
+			So(location("https://wda.ons.gov.uk/ons/apiservice/web/x"), ShouldEqual, "https://www.ons.gov.uk/wda")
+		})
+
+		Convey("Then a Welsh page given with a host's page is used", func() {
+			So(location("https://web.ons.gov.uk/ons/apiservice/web/x"), ShouldEqual, "https://cy.ons.gov.uk/web")
+		})
+
+		Convey("Then the rule set's Welsh page is used for its own landing page", func() {
+			So(location("https://example.com/"), ShouldEqual, "https://cy.ons.gov.uk/help")
+		})
+	})
+
+	Convey("Given a rule set with its own Welsh message", t, func() {
+		rules := defaultRules()
+		rules.Languages = map[string]responses{welsh: {GoneMessage: "Wedi mynd."}}
+		So(rules.validate(), ShouldBeNil)
+		router, err := newTestRouter(hc, rules)
+		So(err, ShouldBeNil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "https://cy.neighbourhood.statistics.gov.uk/NDE2/a", nil))
+		So(w.Body.String(), ShouldEqual, "Wedi mynd.")
+	})
+
+	Convey("Unsupported languages fail validation", t, func() {
+		rules := defaultRules()
+		rules.Languages = map[string]responses{"fr": {GoneMessage: "Parti."}}
+		So(rules.validate(), ShouldNotBeNil)
+	})
+}
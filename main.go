@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ONSdigital/dp-healthcheck/healthcheck"
 	"github.com/ONSdigital/dp-legacy-redirector/config"
@@ -16,6 +21,14 @@ var redir = http.StatusTemporaryRedirect
 var landingPage = "https://www.ons.gov.uk/help/localstatistics"
 var apiResponse = "This service is no longer available. Please visit https://www.ons.gov.uk/help/localstatistics for more information."
 
+// Destinations of the built-in handlers, shared with the export command
+const (
+	nessContentPrefix   = "https://www.ons.gov.uk/visualisations/nesscontent/"
+	visualAssetPrefix   = "https://static.ons.gov.uk/visual/"
+	visualArchivePrefix = "http://webarchive.nationalarchives.gov.uk/20171102124620/https://visual.ons.gov.uk/"
+	visualHome          = "https://www.ons.gov.uk"
+)
+
 var (
 	// BuildTime represents the time in which the service was built
 	BuildTime string
@@ -26,8 +39,13 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	log.Namespace = "dp-legacy-redirector"
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
 	cfg, err := config.Get()
 	if err != nil {
@@ -37,130 +55,255 @@ func main() {
 
 	log.Info(ctx, "config on startup", log.Data{"config": cfg, "build_time": BuildTime, "git-commit": GitCommit})
 
+	if err := run(ctx, cfg); err != nil {
+		log.Fatal(ctx, "fatal runtime error", err)
+		os.Exit(1)
+	}
+}
+
+// run serves requests until ctx is cancelled, then reports the service as unhealthy,
+// waits for the drain period so load balancers stop sending traffic, and shuts down
+// the server once in-flight requests complete or the shutdown timeout expires
+func run(ctx context.Context, cfg *config.Config) error {
+	var err error
+	destinations = newDestinationPolicy(cfg.AllowedRedirectHosts, cfg.AllowedRedirectSchemes)
+	localisedLandingPages = cfg.LocalisedLandingPages
+	if trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxy configuration: %w", err)
+	}
+
+	if redaction, err = newRedactor(cfg.RedactionKey, cfg.RedactParams, cfg.RedactPatterns, cfg.RedactPostcodes); err != nil {
+		return err
+	}
+	if clients, err = newClassifier(cfg.UserAgentPatterns); err != nil {
+		return err
+	}
+	log.SetDestination(&redactingWriter{redaction, os.Stdout}, &redactingWriter{redaction, os.Stderr})
+	if len(cfg.RedactionKey) == 0 {
+		log.Warn(ctx, "no redaction key configured, redacted values will only be correlatable within this process")
+	}
+
+	accessLogOutput, err := newAccessLogOutput(cfg.AccessLogFile, cfg.AccessLogMaxSizeMB, cfg.AccessLogMaxBackups)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	defer accessLogOutput.Close()
+	if accessLog, err = newAccessLogger(cfg.AccessLogFormat, accessLogOutput); err != nil {
+		return err
+	}
+
 	// Health check
 	versionInfo, err := healthcheck.NewVersionInfo(BuildTime, GitCommit, Version)
 	if err != nil {
-		log.Fatal(ctx, "Failed to obtain VersionInfo for healthcheck", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to obtain VersionInfo for healthcheck: %w", err)
 	}
 	hc := healthcheck.New(versionInfo, cfg.HealthckeckCriticalTimeout, cfg.HealthckeckInterval)
 
-	srv := server.NewServer(cfg.BindAddr, getRouter(hc))
+	if ruleSigning, err = newSignaturePolicy(cfg.RulesPublicKeys, cfg.RequireSignedRules); err != nil {
+		return err
+	}
+	if len(cfg.AuditLogFile) > 0 {
+		if audit, err = newAuditLog(cfg.AuditLogFile, cfg.AuditLogKey); err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
 
-	log.Info(ctx, "starting http server", log.Data{"bind_addr": cfg.BindAddr})
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal(ctx, "error starting server", err)
-		os.Exit(1)
+	rules := newActiveRules(cfg.RulesFile)
+	if len(cfg.RulesStore) > 0 {
+		if rules.store, err = openRuleStore(cfg.RulesStore); err != nil {
+			return err
+		}
+		defer rules.store.Close()
+		if err := rules.store.checkAudited(audit); err != nil {
+			return err
+		}
+		if _, err := seedRuleStore(rules.store, cfg.RulesFile); err != nil {
+			return fmt.Errorf("failed to seed rules store: %w", err)
+		}
 	}
-}
+	if err := rules.reload(ctx); err != nil {
+		log.Error(ctx, "failed to load rules, will retry", err, log.Data{"rules_file": cfg.RulesFile})
+	}
+	if err := hc.AddCheck("rules", rules.check); err != nil {
+		return fmt.Errorf("failed to add rules health check: %w", err)
+	}
+	if len(cfg.ShadowRulesFile) > 0 {
+		rules.shadow = newActiveRules(cfg.ShadowRulesFile)
+		rules.shadow.candidate = true
+		rules.comparisons = make(chan shadowComparison, shadowQueueSize)
+		if err := rules.shadow.reload(ctx); err != nil {
+			log.Error(ctx, "failed to load shadow rules, will retry", err, log.Data{"rules_file": cfg.ShadowRulesFile})
+		}
+	}
+	hc.Start(context.Background())
+	defer hc.Stop()
 
-func getRouter(hc healthcheck.HealthCheck) *mux.Router {
-	router := mux.NewRouter()
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+	go rules.watch(watchCtx, cfg.RulesReloadInterval)
+	if rules.shadow != nil {
+		go rules.shadow.watch(watchCtx, cfg.RulesReloadInterval)
+		go rules.compareShadows(watchCtx)
+	}
 
-	// Health check
-	router.HandleFunc("/health", hc.Handler)
-
-	// NeSS website
-	router.Host("neighbourhood.statistics.gov.uk").Path("/HTMLDocs/{uri:.*}").HandlerFunc(dataVisHandler)
-	router.Host("{subdomain:[a-z]+}.neighbourhood.statistics.gov.uk").Path("/HTMLDocs/{uri:.*}").HandlerFunc(dataVisHandler)
-	// NeSS API
-	router.Host("neighbourhood.statistics.gov.uk").Path("/NDE2/{uri:.*}").HandlerFunc(apiHandler)
-	router.Host("{subdomain:[a-z]+}.neighbourhood.statistics.gov.uk").Path("/NDE2/{uri:.*}").HandlerFunc(apiHandler)
-	// WDA website
-	router.Host("web.ons.gov.uk").Path("/ons/apiservice/web/{uri:.*}").HandlerFunc(defaultHandler)
-	// WDA API
-	router.Host("web.ons.gov.uk").Path("/ons/apiservice/{uri:.*}").HandlerFunc(apiHandler)
-	router.Host("web.ons.gov.uk").Path("/ons/api/{uri:.*}").HandlerFunc(apiHandler)
-	router.Host("data.ons.gov.uk").Path("/{uri:.*}").HandlerFunc(apiHandler)
-	// Visual.ONS
-	router.Host("visual.ons.gov.uk").Path("/wp-content/uploads/{uri:.*}").HandlerFunc(visualAssetHandler)
-	router.Host("visual.ons.gov.uk").Path("/{article:[^/]*}{uri:/?.*}").HandlerFunc(visualArticleHandler)
-	// Catch-all
-	router.Path("/{uri:.*}").HandlerFunc(defaultHandler)
-
-	return router
+	router := getRouter(&hc, rules)
+
+	servers := []*server.Server{server.NewServer(cfg.BindAddr, router)}
+	if len(cfg.TLSCertFile) > 0 || len(cfg.TLSKeyFile) > 0 {
+		certs, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		go certs.watch(watchCtx, cfg.TLSReloadInterval)
+
+		servers[0].TLSConfig = certs.tlsConfig()
+		servers[0].CertFile = cfg.TLSCertFile
+		servers[0].KeyFile = cfg.TLSKeyFile
+
+		if len(cfg.HTTPBindAddr) > 0 {
+			servers = append(servers, server.NewServer(cfg.HTTPBindAddr, forwardedHeaders(httpsUpgradeHandler(cfg.BindAddr, rules))))
+		}
+	}
+
+	if len(cfg.AdminBindAddr) > 0 {
+		servers = append(servers, server.NewServer(cfg.AdminBindAddr, getAdminRouter(newAdminTokens(cfg.AdminToken, cfg.AdminTokens), rules)))
+	}
+
+	draining.Store(false)
+	serverErrors := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv.HandleOSSignals = false
+		go func(srv *server.Server) {
+			log.Info(ctx, "starting http server", log.Data{"bind_addr": srv.Addr, "tls": len(srv.CertFile) > 0})
+			serverErrors <- srv.ListenAndServe()
+		}(srv)
+	}
+
+	select {
+	case err := <-serverErrors:
+		return fmt.Errorf("error starting server: %w", err)
+	case <-ctx.Done():
+	}
+
+	log.Info(ctx, "shutdown requested, draining", log.Data{"drain_period": cfg.DrainPeriod.String()})
+	draining.Store(true)
+	select {
+	case err := <-serverErrors:
+		return fmt.Errorf("server stopped while draining: %w", err)
+	case <-time.After(cfg.DrainPeriod):
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.GracefulShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("failed to shut down gracefully: %w", err)
+		}
+	}
+	for range servers {
+		if err := <-serverErrors; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+
+	log.Info(ctx, "shutdown complete")
+	return nil
 }
 
-func defaultHandler(w http.ResponseWriter, req *http.Request) {
-	log.Info(req.Context(), "redirecting to landing page", log.Data{
-		"host": req.Host,
-		"path": req.URL.Path,
-		"dest": landingPage,
+// getRouter serves the health check and readiness endpoints, and the legacy sites from
+// the active rules. The endpoints are found by comparing the path rather than with a mux
+// router, which would allocate for every request before the rules' own matcher.
+func getRouter(hc *healthcheck.HealthCheck, rules *activeRules) http.Handler {
+	health := healthHandler(hc)
+	router := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/health":
+			health(w, req)
+		case "/ready":
+			rules.readyHandler(w, req)
+		default:
+			rules.ServeHTTP(w, req)
+		}
 	})
-	w.Header().Set("Location", landingPage)
-	w.WriteHeader(redir)
+	return forwardedHeaders(accessLog.middleware(router))
+}
+
+func defaultHandler(w http.ResponseWriter, req *http.Request) {
+	if localisedLandingPages {
+		varyByLanguage(w, req)
+	}
+	redirect(w, req, "redirecting to landing page", responsesFor(req).LandingPage, log.Data{})
 }
 
 func dataVisHandler(w http.ResponseWriter, req *http.Request) {
-	dest := "https://www.ons.gov.uk/visualisations/nesscontent/" + mux.Vars(req)["uri"]
-	log.Info(req.Context(), "redirecting visualisation", log.Data{
-		"host": req.Host,
-		"path": req.URL.Path,
-		"dest": dest,
-	})
-	w.Header().Set("Location", dest)
-	w.WriteHeader(redir)
+	prefix := nessContentPrefix
+	uri, err := cleanSegment(mux.Vars(req)["uri"])
+	if err != nil {
+		rejectDestination(w, req, prefix+mux.Vars(req)["uri"], err)
+		return
+	}
+
+	redirect(w, req, "redirecting visualisation", prefix+uri, log.Data{})
 }
 
 func apiHandler(w http.ResponseWriter, req *http.Request) {
-	log.Info(req.Context(), "returning api help text", log.Data{
-		"host": req.Host,
-		"path": req.URL.Path,
-	})
+	recordFor(req).Outcome = "gone"
+	if !shadowing(req) {
+		log.Info(req.Context(), "returning api help text", log.Data{
+			"host":   req.Host,
+			"path":   req.URL.Path,
+			"scheme": requestScheme(req),
+		})
+		if key := apiKey(req); len(key) > 0 {
+			apiKeys.record(key, req.UserAgent(), clientFor(req), time.Now().UTC())
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Language", languageFor(req))
+	varyByLanguage(w, req)
 	w.WriteHeader(410)
-	_, err := w.Write([]byte(apiResponse))
+	_, err := w.Write([]byte(responsesFor(req).GoneMessage))
 	if err != nil {
 		log.Error(req.Context(), "error writing response", err)
 	}
 }
 
 func visualAssetHandler(w http.ResponseWriter, req *http.Request) {
-	dest := "https://static.ons.gov.uk/visual/" + mux.Vars(req)["uri"]
-	log.Info(req.Context(), "redirecting visual.ons.gov.uk wp-content", log.Data{
-		"host": req.Host,
-		"path": req.URL.Path,
-		"dest": dest,
-	})
-	w.Header().Set("Location", dest)
-	w.WriteHeader(redir)
+	prefix := visualAssetPrefix
+	uri, err := cleanSegment(mux.Vars(req)["uri"])
+	if err != nil {
+		rejectDestination(w, req, prefix+mux.Vars(req)["uri"], err)
+		return
+	}
+
+	redirect(w, req, "redirecting visual.ons.gov.uk wp-content", prefix+uri, log.Data{})
 }
 
 func visualArticleHandler(w http.ResponseWriter, req *http.Request) {
 	article := mux.Vars(req)["article"]
 	uri := mux.Vars(req)["uri"]
+	data := log.Data{
+		"article": article,
+		"uri":     uri,
+	}
 
 	if len(article) == 0 {
-		log.Info(req.Context(), "redirecting visual request to ONS", log.Data{
-			"article": article,
-			"uri":     uri,
-			"host":    req.Host,
-			"path":    req.URL.Path,
-		})
-
-		w.Header().Set("Location", "https://www.ons.gov.uk")
-		w.WriteHeader(redir)
+		redirect(w, req, "redirecting visual request to ONS", visualHome, data)
 		return
 	}
 
-	if dest, ok := visualRedirects[article]; ok {
-		log.Info(req.Context(), "redirecting visual request to ONS", log.Data{
-			"article": article,
-			"uri":     uri,
-			"host":    req.Host,
-			"path":    req.URL.Path,
-		})
+	if dest, ok := redirectsFor(req)[article]; ok {
+		redirect(w, req, "redirecting visual request to ONS", dest, data)
+		return
+	}
 
-		w.Header().Set("Location", dest)
-		w.WriteHeader(redir)
+	archived := visualArchivePrefix
+	page, err := cleanSegment(article + uri)
+	if err != nil {
+		rejectDestination(w, req, archived+article+uri, err)
 		return
 	}
 
-	log.Info(req.Context(), "redirecting visual request to national archives", log.Data{
-		"article": article,
-		"uri":     uri,
-		"host":    req.Host,
-		"path":    req.URL.Path,
-	})
-	w.Header().Set("Location", "http://webarchive.nationalarchives.gov.uk/20171102124620/https://visual.ons.gov.uk/"+article+uri)
-	w.WriteHeader(redir)
+	redirect(w, req, "redirecting visual request to national archives", archived+page, data)
 }
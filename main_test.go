@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	"github.com/ONSdigital/dp-legacy-redirector/config"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -35,12 +38,28 @@ var tests = []urlTest{
 	{"https://visual.ons.gov.uk/how-long-will-my-pension-need-to-last", redir, "", "https://www.ons.gov.uk/peoplepopulationandcommunity/birthsdeathsandmarriages/lifeexpectancies/articles/howlongwillmypensionneedtolast/2015-03-27"},
 	{"https://visual.ons.gov.uk/wp-content/uploads/a/b/c", redir, "", "https://static.ons.gov.uk/visual/a/b/c"},
 	{"https://visual.ons.gov.uk/", redir, "", "https://www.ons.gov.uk"},
+	// Unsafe destinations
+	{"https://visual.ons.gov.uk/wp-content/uploads/a%250d%250aSet-Cookie:%20x=y", 400, "", ""},
+	{"https://neighbourhood.statistics.gov.uk/HTMLDocs/a%5C%5Cevil.com", 400, "", ""},
+	{"https://visual.ons.gov.uk/a%250aLocation:%20evil.com", 400, "", ""},
+}
+
+// newTestRouter returns the service router serving rules
+func newTestRouter(hc healthcheck.HealthCheck, rules *ruleSet) (http.Handler, error) {
+	active := newActiveRules("")
+	if err := active.set(rules); err != nil {
+		return nil, err
+	}
+	return getRouter(&hc, active), nil
 }
 
 func TestRedirects(t *testing.T) {
 	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
 	hc := healthcheck.New(versionInfo, time.Second*10, time.Minute)
-	router := getRouter(hc)
+	router, err := newTestRouter(hc, defaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for _, test := range tests {
 		Convey(test.url, t, func() {
@@ -56,3 +75,77 @@ func TestRedirects(t *testing.T) {
 		})
 	}
 }
+
+func TestGracefulShutdown(t *testing.T) {
+	defer draining.Store(false)
+
+	Convey("Given a running server", t, func() {
+		addr := freeAddr()
+
+		BuildTime = "0"
+		cfg, err := config.Get()
+		So(err, ShouldBeNil)
+		cfg.BindAddr = addr
+		cfg.DrainPeriod = time.Millisecond * 300
+		cfg.GracefulShutdownTimeout = time.Second
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done := make(chan error, 1)
+		go func() { done <- run(ctx, cfg) }()
+
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		get := func(path string) (int, error) {
+			resp, err := client.Get("http://" + addr + path)
+			if err != nil {
+				return 0, err
+			}
+			resp.Body.Close()
+			return resp.StatusCode, nil
+		}
+
+		So(waitFor(func() bool { code, _ := get("/health"); return code == http.StatusOK }), ShouldBeTrue)
+
+		Convey("When shutdown is requested", func() {
+			cancel()
+
+			Convey("Then the health check fails while requests are still served", func() {
+				So(waitFor(func() bool { code, _ := get("/health"); return code == http.StatusServiceUnavailable }), ShouldBeTrue)
+				code, err := get("/ons/apiservice/web/")
+				So(err, ShouldBeNil)
+				So(code, ShouldEqual, redir)
+
+				Convey("And the server stops once the drain period has passed", func() {
+					select {
+					case err := <-done:
+						So(err, ShouldBeNil)
+					case <-time.After(time.Second * 5):
+						t.Fatal("server did not shut down")
+					}
+					_, err := get("/health")
+					So(err, ShouldNotBeNil)
+				})
+			})
+		})
+	})
+}
+
+// freeAddr returns a local address with a port that is free to listen on
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	return false
+}
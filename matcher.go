@@ -0,0 +1,393 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// routeMatcher serves the routes of a rule set, finding the route for a request with a
+// trie of the routes' literal path prefixes for each host. Routes keep the precedence of
+// the rules file: the first route, in site and route order, whose host, path and
+// conditions match the request is served, exactly as if every route were tried in turn.
+type routeMatcher struct {
+	hosts    map[string]*trieNode // routes that can match each host named exactly by a site
+	fallback *trieNode            // routes that can match any other host
+}
+
+// matchRoute is a route ready to be matched and served
+type matchRoute struct {
+	order   int
+	id      string
+	hosts   hostPatterns
+	exact   []string // the host names in hosts that aren't wildcards or regexps
+	path    *pathTemplate
+	route   *compiledRoute
+	handler http.Handler
+}
+
+// trieNode holds the routes whose path's literal prefix ends with the node's prefix,
+// by precedence, and children for longer prefixes, each starting with a different byte
+type trieNode struct {
+	prefix   string
+	children []*trieNode
+	entries  []trieEntry
+}
+
+// trieEntry is a route in a trie, which only needs its host checked if the trie is for
+// hosts not named exactly
+type trieEntry struct {
+	*matchRoute
+	checkHost bool
+}
+
+// newRouteMatcher returns a matcher for routes, which must be in precedence order
+func newRouteMatcher(routes []*matchRoute) *routeMatcher {
+	m := &routeMatcher{hosts: map[string]*trieNode{}, fallback: &trieNode{}}
+	for _, r := range routes {
+		for _, host := range r.exact {
+			if _, ok := m.hosts[host]; !ok {
+				m.hosts[host] = &trieNode{}
+			}
+		}
+	}
+
+	for _, r := range routes {
+		for host, t := range m.hosts {
+			if len(r.hosts) == 0 || r.hosts.matchHost(host) {
+				t.insert(r.path.prefix, trieEntry{matchRoute: r})
+			}
+		}
+		if len(r.hosts) == 0 || len(r.exact) < len(r.hosts) {
+			m.fallback.insert(r.path.prefix, trieEntry{matchRoute: r, checkHost: len(r.hosts) > 0})
+		}
+	}
+	return m
+}
+
+// insert adds e to the node for prefix, splitting nodes as needed
+func (n *trieNode) insert(prefix string, e trieEntry) {
+	for len(prefix) > 0 {
+		child := n.child(prefix[0])
+		if child == nil {
+			child = &trieNode{prefix: prefix}
+			n.children = append(n.children, child)
+			n = child
+			break
+		}
+
+		common := 0
+		for common < len(prefix) && common < len(child.prefix) && prefix[common] == child.prefix[common] {
+			common++
+		}
+		if common < len(child.prefix) {
+			split := &trieNode{prefix: child.prefix[:common], children: []*trieNode{child}}
+			n.replace(split)
+			child.prefix = child.prefix[common:]
+			child = split
+		}
+		prefix = prefix[common:]
+		n = child
+	}
+	n.entries = append(n.entries, e)
+}
+
+func (n *trieNode) child(b byte) *trieNode {
+	for _, c := range n.children {
+		if c.prefix[0] == b {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *trieNode) replace(child *trieNode) {
+	for i, c := range n.children {
+		if c.prefix[0] == child.prefix[0] {
+			n.children[i] = child
+			return
+		}
+	}
+}
+
+// match returns the route serving req, or nil if there isn't one
+func (m *routeMatcher) match(req *http.Request) *matchRoute {
+	host := normaliseHost(req.Host)
+	t, ok := m.hosts[host]
+	if !ok {
+		t = m.fallback
+	}
+	p := req.URL.Path
+
+	// The nodes whose prefix p starts with, and how much of p they consume
+	var nodeBuf [16]*trieNode
+	var depthBuf [16]int
+	nodes, depths := append(nodeBuf[:0], t), append(depthBuf[:0], 0)
+	for n, depth := t, 0; depth < len(p); {
+		if n = n.child(p[depth]); n == nil || !strings.HasPrefix(p[depth:], n.prefix) {
+			break
+		}
+		depth += len(n.prefix)
+		nodes, depths = append(nodes, n), append(depths, depth)
+	}
+
+	// Try the candidates from every node in precedence order, as each node's entries
+	// are already in order
+	var cursorBuf [16]int
+	cursors := cursorBuf[:0]
+	for range nodes {
+		cursors = append(cursors, 0)
+	}
+	for {
+		next := -1
+		for i, n := range nodes {
+			if cursors[i] < len(n.entries) && (next < 0 || n.entries[cursors[i]].order < nodes[next].entries[cursors[next]].order) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return nil
+		}
+		e := nodes[next].entries[cursors[next]]
+		cursors[next]++
+		if e.matches(req, host, p, depths[next]) {
+			return e.matchRoute
+		}
+	}
+}
+
+// matches checks the entry's host, the rest of its path after the trie prefix and its
+// conditions, in the order they were checked when routes were registered with mux.
+// Conditions are given the path variables the route's handler will have.
+func (e trieEntry) matches(req *http.Request, host, p string, prefixLen int) bool {
+	if e.checkHost && !e.hosts.matchHost(host) {
+		return false
+	}
+	if !e.path.match(p, prefixLen) {
+		return false
+	}
+	cr := e.route
+	if cr.when != nil && !cr.when.match(req, nil) {
+		return false
+	}
+	if cr.cond != nil && !cr.cond.match(req, &mux.RouteMatch{Vars: e.path.vars(p)}) {
+		return false
+	}
+	return cr.window == nil || cr.window.match(req, nil)
+}
+
+// ServeHTTP redirects requests for unclean paths to the clean path, as mux does, and
+// serves the others with their route's handler, with its path variables set for mux.Vars
+func (m *routeMatcher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if p := cleanPath(req.URL.Path); p != req.URL.Path {
+		u := *req.URL
+		u.Path = p
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+
+	r := m.match(req)
+	if r == nil {
+		http.NotFound(w, req)
+		return
+	}
+	if vars := r.path.vars(req.URL.Path); len(vars) > 0 {
+		req = mux.SetURLVars(req, vars)
+	}
+	r.handler.ServeHTTP(w, req)
+}
+
+// cleanPath returns the canonical form of p, keeping any trailing slash, as mux does
+func cleanPath(p string) string {
+	if len(p) == 0 {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+// Kinds of pathToken
+const (
+	tokenLiteral = iota
+	tokenSegment // a variable matching [^/]+ or [^/]*
+	tokenRest    // a variable matching .* or .+, the last in the template
+)
+
+type pathToken struct {
+	kind    int
+	literal string
+	name    string
+	min     int
+}
+
+// pathTemplate is a compiled gorilla/mux path template. Templates whose variables use
+// the common patterns are matched by scanning the path; others with mux's regexp.
+type pathTemplate struct {
+	template string
+	prefix   string      // literal text before the first variable
+	tokens   []pathToken // the template after prefix, if it can be scanned
+	re       *regexp.Regexp
+	names    []string
+}
+
+// compilePath compiles a mux path template, returning mux's error for invalid ones
+func compilePath(template string) (*pathTemplate, error) {
+	route := mux.NewRouter().Path(template)
+	expr, err := route.GetPathRegexp()
+	if err != nil {
+		return nil, err
+	}
+	names, err := route.GetVarNames()
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	pt := &pathTemplate{template: template, prefix: template, re: re, names: names}
+	if i := strings.IndexByte(template, '{'); i >= 0 {
+		pt.prefix = template[:i]
+	}
+
+	var tokens []pathToken
+	scannable := true
+	for rest := template[len(pt.prefix):]; len(rest) > 0; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			tokens = append(tokens, pathToken{kind: tokenLiteral, literal: rest})
+			break
+		}
+		if start > 0 {
+			tokens = append(tokens, pathToken{kind: tokenLiteral, literal: rest[:start]})
+		}
+		end := closingBrace(rest, start)
+		name, pattern, ok := strings.Cut(rest[start+1:end], ":")
+		if !ok {
+			pattern = "[^/]+"
+		}
+		switch pattern {
+		case "[^/]+":
+			tokens = append(tokens, pathToken{kind: tokenSegment, name: name, min: 1})
+		case "[^/]*":
+			tokens = append(tokens, pathToken{kind: tokenSegment, name: name})
+		case ".+":
+			tokens = append(tokens, pathToken{kind: tokenRest, name: name, min: 1})
+		case ".*", "/?.*":
+			tokens = append(tokens, pathToken{kind: tokenRest, name: name})
+		default:
+			scannable = false
+		}
+		rest = rest[end+1:]
+	}
+
+	for i, t := range tokens {
+		var next *pathToken
+		if i+1 < len(tokens) {
+			next = &tokens[i+1]
+		}
+		switch {
+		case t.kind == tokenRest && next != nil:
+			scannable = false
+		case t.kind == tokenSegment && next != nil && !(next.kind == tokenRest && next.min == 0) &&
+			!(next.kind == tokenLiteral && strings.HasPrefix(next.literal, "/")):
+			// Anything else following a segment could need backtracking, such as a rest
+			// that must take at least one character from the end of the segment
+			scannable = false
+		}
+	}
+	if scannable {
+		pt.tokens = tokens
+		if pt.tokens == nil {
+			pt.tokens = []pathToken{}
+		}
+	}
+	return pt, nil
+}
+
+// closingBrace returns the index of the brace closing the one at start, allowing for
+// braces in the variable's pattern; mux has already checked they're balanced
+func closingBrace(s string, start int) int {
+	level := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			level++
+		case '}':
+			if level--; level == 0 {
+				return i
+			}
+		}
+	}
+	return len(s) - 1
+}
+
+// match reports whether p, which starts with the template's prefix, matches the
+// template. prefixLen is the length of the prefix.
+func (pt *pathTemplate) match(p string, prefixLen int) bool {
+	if pt.tokens == nil {
+		return pt.re.MatchString(p)
+	}
+	return pt.scan(p[prefixLen:], nil)
+}
+
+// vars returns the template's variables in p, which matches it
+func (pt *pathTemplate) vars(p string) map[string]string {
+	if len(pt.names) == 0 {
+		return nil
+	}
+	vars := make(map[string]string, len(pt.names))
+	if pt.tokens == nil {
+		for i, v := range pt.re.FindStringSubmatch(p)[1:] {
+			vars[pt.names[i]] = v
+		}
+		return vars
+	}
+	pt.scan(p[len(pt.prefix):], vars)
+	return vars
+}
+
+// scan matches the tokens against p, storing variables in vars if it isn't nil. Segments
+// take as much as they can, as mux's regexps do.
+func (pt *pathTemplate) scan(p string, vars map[string]string) bool {
+	for _, t := range pt.tokens {
+		var n int
+		switch t.kind {
+		case tokenLiteral:
+			if !strings.HasPrefix(p, t.literal) {
+				return false
+			}
+			p = p[len(t.literal):]
+			continue
+		case tokenSegment:
+			if n = strings.IndexByte(p, '/'); n < 0 {
+				n = len(p)
+			}
+		case tokenRest:
+			// . doesn't match a new line
+			if strings.IndexByte(p, '\n') >= 0 {
+				return false
+			}
+			n = len(p)
+		}
+		if n < t.min {
+			return false
+		}
+		if vars != nil {
+			vars[t.name] = p[:n]
+		}
+		p = p[n:]
+	}
+	return len(p) == 0
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/gorilla/mux"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// muxRouter registers routes with gorilla/mux, as rules were served before the trie
+// matcher, for the matcher to be checked and benchmarked against
+func muxRouter(routes []*matchRoute) *mux.Router {
+	router := mux.NewRouter()
+	for _, r := range routes {
+		mr := router.MatcherFunc(r.hosts.match).Path(r.path.template)
+		if r.route.when != nil {
+			mr = mr.MatcherFunc(r.route.when.match)
+		}
+		if r.route.cond != nil {
+			mr = mr.MatcherFunc(r.route.cond.match)
+		}
+		if r.route.window != nil {
+			mr = mr.MatcherFunc(r.route.window.match)
+		}
+		mr.Name(r.id).Handler(r.handler)
+	}
+	return router
+}
+
+// matcherRules returns the built-in rules after a site using every kind of host pattern
+// and path template
+func matcherRules() *ruleSet {
+	rs := defaultRules()
+	legacy := site{
+		Name:  "legacy",
+		Hosts: []string{"legacy.ons.gov.uk", `~legacy[0-9]+\.ons\.gov\.uk`, "*.legacy.ons.gov.uk"},
+		Routes: []route{
+			{ID: "exact-post", Path: "/exact", Handler: "gone", When: &conditions{Methods: []string{"POST"}}},
+			{ID: "exact", Path: "/exact", Handler: "landing"},
+			{ID: "pdf", Path: "/files/{name}.pdf", Handler: "landing"},
+			{ID: "year", Path: "/{year:[0-9]{4}}/{uri:.*}", Handler: "landing"},
+			{ID: "pair", Path: "/p/{a}/{b:.*}", Handler: "landing"},
+			{ID: "single", Path: "/p/{a:[^/]*}", Handler: "landing"},
+			{ID: "api", Path: "/api/{v:.+}", Handler: "gone"},
+			{ID: "split", Path: "/s/{a}{b:.+}", Handler: "landing"},
+			{ID: "split-optional", Path: "/t/{a:[^/]*}{b:.+}", Handler: "landing"},
+			{ID: "ness-shadowed", Path: "/HTMLDocs/{uri:.*}", Handler: "landing"},
+		},
+	}
+	rs.Sites = append([]site{legacy}, rs.Sites...)
+	return rs
+}
+
+func TestRouteMatcher(t *testing.T) {
+	Convey("Given the trie matcher and mux router for the same routes", t, func() {
+		routes, err := matcherRules().routes()
+		So(err, ShouldBeNil)
+		m, router := newRouteMatcher(routes), muxRouter(routes)
+
+		hosts := []string{
+			"legacy.ons.gov.uk", "LEGACY.ons.gov.uk:443", "legacy42.ons.gov.uk", "a.legacy.ons.gov.uk",
+			"neighbourhood.statistics.gov.uk", "www.neighbourhood.statistics.gov.uk", "web.ons.gov.uk",
+			"data.ons.gov.uk", "visual.ons.gov.uk", "example.com", "[::1]:80",
+		}
+		paths := []string{
+			"/", "/exact", "/exact/", "/exactly", "/files/a.pdf", "/files/a/b.pdf", "/files/.pdf",
+			"/2019/report", "/2019/", "/201/report", "/p/a/b/c", "/p/a/", "/p/a", "/p/", "/p//b",
+			"/api/", "/api/v1", "/s/abc", "/s/a", "/s/ab/c", "/s/", "/t/abc", "/t/a", "/t/", "/t/a/b",
+			"/HTMLDocs/a/b.html", "/HTMLDocs/a\nb", "/HTMLDocs", "/NDE2/x",
+			"/ons/apiservice/web/x", "/ons/apiservice/x", "/ons/api/", "/ons/api",
+			"/wp-content/uploads/2016/a.png", "/binge-drinking", "/binge-drinking/x", "/a\nb", "/a\nb/c\nd",
+		}
+
+		Convey("Then every request is matched to the same route with the same variables", func() {
+			for _, host := range hosts {
+				for _, path := range paths {
+					for _, method := range []string{"GET", "POST"} {
+						req := httptest.NewRequest(method, "/", nil)
+						req.Host, req.URL.Path = host, path
+
+						var want mux.RouteMatch
+						wantID := "none"
+						if router.Match(req, &want) {
+							wantID = want.Route.GetName()
+						}
+						gotID, vars := "none", map[string]string(nil)
+						if r := m.match(req); r != nil {
+							gotID, vars = r.id, r.path.vars(path)
+						}
+
+						So(fmt.Sprint(method, " ", host, path, " ", gotID), ShouldEqual, fmt.Sprint(method, " ", host, path, " ", wantID))
+						if len(want.Vars) > 0 {
+							So(vars, ShouldResemble, want.Vars)
+						}
+					}
+				}
+			}
+		})
+
+		Convey("Then unclean paths are redirected to the clean path", func() {
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, httptest.NewRequest("GET", "http://legacy.ons.gov.uk/p/../exact?a=1", nil))
+			So(w.Code, ShouldEqual, http.StatusMovedPermanently)
+			So(w.Header().Get("Location"), ShouldEqual, "http://legacy.ons.gov.uk/exact?a=1")
+		})
+
+		Convey("Then exact and article paths are matched without allocating", func() {
+			for _, target := range []string{"http://legacy.ons.gov.uk/exact", "http://visual.ons.gov.uk/binge-drinking"} {
+				req := httptest.NewRequest("GET", target, nil)
+				So(testing.AllocsPerRun(100, func() { m.match(req) }), ShouldEqual, 0)
+			}
+		})
+
+	})
+
+	Convey("Given the service router serving the built-in rules", t, func() {
+		log.SetDestination(io.Discard, io.Discard)
+		defer log.SetDestination(os.Stdout, os.Stderr)
+		defer func(l *accessLogger) { accessLog = l }(accessLog)
+		accessLog = nil
+		router, err := newTestRouter(healthcheck.HealthCheck{}, defaultRules())
+		So(err, ShouldBeNil)
+		w := discardResponse{header: http.Header{}}
+
+		Convey("Then redirects allocate only for their path variables, destination and Location header, besides logging", func() {
+			for _, target := range []string{"http://visual.ons.gov.uk/binge-drinking", "http://web.ons.gov.uk/ons/apiservice/web/x"} {
+				req := shadowCopy(httptest.NewRequest("GET", target, nil))
+				router.ServeHTTP(w, req)
+				So(w.header.Get("Location"), ShouldNotBeEmpty)
+				So(testing.AllocsPerRun(100, func() { router.ServeHTTP(w, req) }), ShouldBeLessThanOrEqualTo, 8)
+			}
+		})
+	})
+
+	Convey("Invalid path templates are rejected", t, func() {
+		_, err := compilePath("/{uri")
+		So(err, ShouldNotBeNil)
+		_, err = compilePath("/{uri:}")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// shadowCopy returns req as the shadow rule set serves it, which is the same as any
+// other request except that nothing is logged or counted
+func shadowCopy(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), recordKey{}, &requestRecord{shadow: true}))
+}
+
+// discardResponse is a ResponseWriter that discards the response, reusing its header
+type discardResponse struct {
+	header http.Header
+}
+
+func (d discardResponse) Header() http.Header       { return d.header }
+func (discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (discardResponse) WriteHeader(int)             {}
+
+// benchmarkRules returns the built-in rules after a site with n exact path routes
+func benchmarkRules(n int) *ruleSet {
+	rs := defaultRules()
+	legacy := site{Name: "legacy", Hosts: []string{"legacy.ons.gov.uk"}}
+	for i := 0; i < n; i++ {
+		legacy.Routes = append(legacy.Routes, route{ID: fmt.Sprintf("page-%d", i), Path: fmt.Sprintf("/pages/%d/index.html", i), Handler: "landing"})
+	}
+	rs.Sites = append([]site{legacy}, rs.Sites...)
+	return rs
+}
+
+func BenchmarkRouteMatching(b *testing.B) {
+	routes, err := benchmarkRules(2000).routes()
+	if err != nil {
+		b.Fatal(err)
+	}
+	m, router := newRouteMatcher(routes), muxRouter(routes)
+
+	log.SetDestination(io.Discard, io.Discard)
+	defer log.SetDestination(os.Stdout, os.Stderr)
+	defer func(l *accessLogger) { accessLog = l }(accessLog)
+	accessLog = nil
+	served, err := newTestRouter(healthcheck.HealthCheck{}, defaultRules())
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := discardResponse{header: http.Header{}}
+
+	requests := map[string]string{
+		"exact":     "http://legacy.ons.gov.uk/pages/1999/index.html",
+		"article":   "http://visual.ons.gov.uk/binge-drinking",
+		"catch-all": "http://example.com/unknown/page",
+	}
+	for _, name := range []string{"exact", "article", "catch-all"} {
+		req := httptest.NewRequest("GET", requests[name], nil)
+		b.Run("trie/"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.match(req)
+			}
+		})
+		b.Run("mux/"+name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				router.Match(req, &mux.RouteMatch{})
+			}
+		})
+	}
+
+	// The service router serving the built-in rules, with and without logging
+	for _, target := range []string{"http://visual.ons.gov.uk/binge-drinking", "http://web.ons.gov.uk/ons/apiservice/web/x"} {
+		req := httptest.NewRequest("GET", target, nil)
+		b.Run("serve/"+req.Host, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				served.ServeHTTP(w, req)
+			}
+		})
+		shadowed := shadowCopy(req)
+		b.Run("serve-unlogged/"+req.Host, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				served.ServeHTTP(w, shadowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is replaced in main with the CIDRs from the service configuration
+var trustedProxies []*net.IPNet
+
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if len(cidr) == 0 {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeaders replaces the request host and scheme with the X-Forwarded-Host and
+// X-Forwarded-Proto values set by a trusted proxy, and normalises the host so that
+// route matching ignores ports and letter case
+func forwardedHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+
+		if isTrustedProxy(req.RemoteAddr) {
+			if fwdHost := firstHeaderValue(req, "X-Forwarded-Host"); len(fwdHost) > 0 {
+				host = fwdHost
+			}
+			if fwdProto := strings.ToLower(firstHeaderValue(req, "X-Forwarded-Proto")); fwdProto == "http" || fwdProto == "https" {
+				scheme = fwdProto
+			}
+		} else if req.URL.IsAbs() {
+			scheme = req.URL.Scheme
+		}
+
+		host = normaliseHost(host)
+		req.Host = host
+		if len(req.URL.Host) > 0 {
+			req.URL.Host = host
+		}
+
+		req, record := withRecord(req)
+		record.scheme = scheme
+		h.ServeHTTP(w, req)
+	})
+}
+
+// clientIP returns the address of the client, taken from X-Forwarded-For when the
+// request came through trusted proxies
+func clientIP(req *http.Request) string {
+	remote, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remote = req.RemoteAddr
+	}
+	if !isTrustedProxy(req.RemoteAddr) {
+		return remote
+	}
+
+	hops := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if len(hop) == 0 {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
+
+func firstHeaderValue(req *http.Request, name string) string {
+	value, _, _ := strings.Cut(req.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// normaliseHost lower-cases host and strips any port and trailing dot
+func normaliseHost(host string) string {
+	// Hosts without a port are common and SplitHostPort allocates an error for them
+	if strings.IndexByte(host, ':') < 0 {
+		return strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// requestScheme returns the scheme the client used to reach the load balancer
+func requestScheme(req *http.Request) string {
+	if scheme := recordFor(req).scheme; len(scheme) > 0 {
+		return scheme
+	}
+	return "http"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	router, err := newTestRouter(healthcheck.New(versionInfo, time.Second*10, time.Minute), defaultRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a trusted proxy range", t, func() {
+		var err error
+		trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+		So(err, ShouldBeNil)
+		Reset(func() { trustedProxies = nil })
+
+		Convey("When a request arrives from a trusted proxy with X-Forwarded-Host", func() {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/HTMLDocs/a/b", nil)
+			req.Host = "10.0.1.2:8080"
+			req.RemoteAddr = "10.1.2.3:41234"
+			req.Header.Set("X-Forwarded-Host", "Neighbourhood.Statistics.gov.uk:443, proxy.internal")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			router.ServeHTTP(w, req)
+
+			Convey("Then the forwarded host is used for matching", func() {
+				So(w.Code, ShouldEqual, redir)
+				So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/visualisations/nesscontent/a/b")
+			})
+		})
+
+		Convey("When a request arrives from an untrusted client with X-Forwarded-Host", func() {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/HTMLDocs/a/b", nil)
+			req.Host = "web.ons.gov.uk"
+			req.RemoteAddr = "203.0.113.9:41234"
+			req.Header.Set("X-Forwarded-Host", "neighbourhood.statistics.gov.uk")
+			router.ServeHTTP(w, req)
+
+			Convey("Then the forwarded host is ignored", func() {
+				So(w.Code, ShouldEqual, redir)
+				So(w.Header().Get("Location"), ShouldEqual, landingPage)
+			})
+		})
+
+		Convey("When the Host header has a port and mixed case", func() {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/NDE2/a", nil)
+			req.Host = "NEIGHBOURHOOD.statistics.gov.uk:8443"
+			router.ServeHTTP(w, req)
+
+			Convey("Then the host still matches", func() {
+				So(w.Code, ShouldEqual, 410)
+			})
+		})
+	})
+
+	Convey("Invalid trusted proxies are rejected", t, func() {
+		_, err := parseTrustedProxies([]string{"10.0.0.0/33"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestNormaliseHost(t *testing.T) {
+	Convey("normaliseHost strips ports and lower-cases", t, func() {
+		So(normaliseHost("WEB.ons.gov.uk:443"), ShouldEqual, "web.ons.gov.uk")
+		So(normaliseHost("web.ons.gov.uk."), ShouldEqual, "web.ons.gov.uk")
+		So(normaliseHost("[::1]:80"), ShouldEqual, "::1")
+		So(normaliseHost("data.ons.gov.uk"), ShouldEqual, "data.ons.gov.uk")
+	})
+
+	Convey("requestScheme falls back to http without context", t, func() {
+		So(requestScheme(httptest.NewRequest("GET", "/", nil)), ShouldEqual, "http")
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// postcodePattern matches UK postcodes, including URL encoded forms such as SW1A+1AA.
+// The letters are restricted to those used in each position so that NeSS dataset
+// codes like QS101EW aren't mistaken for postcodes.
+var postcodePattern = regexp.MustCompile(`(?i)\b[A-PR-UWYZ][A-HK-Y]?[0-9][A-Z0-9]?(?:\s|\+|%20)?[0-9][ABD-HJLNP-UW-Z]{2}\b`)
+
+// redactor replaces sensitive values in logs with a keyed hash, so values can't be
+// recovered but repeat callers can still be correlated
+type redactor struct {
+	key      []byte
+	params   map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// redaction is replaced in main with a redactor configured from the service configuration.
+// A nil redactor leaves values unchanged.
+var redaction *redactor
+
+func newRedactor(key string, params, patterns []string, postcodes bool) (*redactor, error) {
+	r := &redactor{key: []byte(key), params: map[string]bool{}}
+	if len(r.key) == 0 {
+		r.key = make([]byte, 32)
+		if _, err := rand.Read(r.key); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range params {
+		if p = strings.ToLower(strings.TrimSpace(p)); len(p) > 0 {
+			r.params[p] = true
+		}
+	}
+	for _, p := range patterns {
+		if len(strings.TrimSpace(p)) == 0 {
+			continue
+		}
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	if postcodes {
+		r.patterns = append(r.patterns, postcodePattern)
+	}
+	return r, nil
+}
+
+// hash returns the replacement for a sensitive value
+func (r *redactor) hash(value string) string {
+	return "[redacted:" + r.hashHex(value) + "]"
+}
+
+// hashHex returns a short keyed hash of value, without the redaction marker
+func (r *redactor) hashHex(value string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// text redacts any matches of the configured patterns in s
+func (r *redactor) text(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllStringFunc(s, r.hash)
+	}
+	return s
+}
+
+// query redacts the values of sensitive parameters in a raw query string, then
+// redacts pattern matches in what remains
+func (r *redactor) query(rawQuery string) string {
+	if r == nil || len(rawQuery) == 0 {
+		return rawQuery
+	}
+
+	parts := strings.Split(rawQuery, "&")
+	for i, part := range parts {
+		name, value, ok := strings.Cut(part, "=")
+		decoded, err := url.QueryUnescape(name)
+		if err != nil {
+			decoded = name
+		}
+		if ok && r.params[strings.ToLower(decoded)] {
+			parts[i] = name + "=" + r.hash(value)
+		}
+	}
+	return r.text(strings.Join(parts, "&"))
+}
+
+// uri redacts a request URI or URL, including its query string
+func (r *redactor) uri(s string) string {
+	if r == nil {
+		return s
+	}
+	path, query, ok := strings.Cut(s, "?")
+	if !ok {
+		return r.text(s)
+	}
+	return r.text(path) + "?" + r.query(query)
+}
+
+// value redacts v, recursing into maps and slices. Values under keys matching a sensitive
+// parameter name are hashed in full.
+func (r *redactor) value(key string, v interface{}) interface{} {
+	if r == nil {
+		return v
+	}
+	if r.params[strings.ToLower(key)] {
+		return r.hash(fmt.Sprint(v))
+	}
+
+	switch t := v.(type) {
+	case string:
+		if key == "query" {
+			return r.query(t)
+		}
+		return r.uri(t)
+	case map[string]interface{}:
+		for k, inner := range t {
+			t[k] = r.value(k, inner)
+		}
+		return t
+	case []interface{}:
+		for i, inner := range t {
+			t[i] = r.value(key, inner)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// redactingWriter redacts log events before writing them to out. JSON events have
+// their data and http fields redacted; anything else is redacted as plain text.
+type redactingWriter struct {
+	r   *redactor
+	out io.Writer
+}
+
+func (w *redactingWriter) Write(b []byte) (int, error) {
+	var event map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&event); err != nil {
+		if _, err := io.WriteString(w.out, w.r.text(string(b))); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	for _, field := range []string{"data", "http"} {
+		if v, ok := event[field]; ok {
+			event[field] = w.r.value(field, v)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(event); err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
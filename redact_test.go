@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRedactor(t *testing.T) {
+	Convey("Given a redactor with parameter names, a pattern and postcode detection", t, func() {
+		r, err := newRedactor("secret", []string{"apikey", "Token"}, []string{`[0-9]{3}-[0-9]{4}`}, true)
+		So(err, ShouldBeNil)
+
+		Convey("Then sensitive query parameters are replaced with a stable hash", func() {
+			redacted := r.uri("/ons/api/data?apikey=abc123&dataset=QS101EW&TOKEN=x")
+			So(redacted, ShouldNotContainSubstring, "abc123")
+			So(redacted, ShouldContainSubstring, "dataset=QS101EW")
+			So(redacted, ShouldContainSubstring, "apikey="+r.hash("abc123"))
+			So(redacted, ShouldContainSubstring, "TOKEN="+r.hash("x"))
+			So(r.uri("/ons/api/other?apikey=abc123"), ShouldContainSubstring, r.hash("abc123"))
+		})
+
+		Convey("Then postcodes are redacted from paths and queries", func() {
+			So(r.uri("/NDE2/Disco/FindAreas?Postcode=SW1A+1AA"), ShouldNotContainSubstring, "SW1A")
+			So(r.text("/HTMLDocs/area/np10 8xg/index.html"), ShouldNotContainSubstring, "np10 8xg")
+			So(r.text("/HTMLDocs/a/b/c"), ShouldEqual, "/HTMLDocs/a/b/c")
+		})
+
+		Convey("Then configured patterns are redacted", func() {
+			So(r.text("call 555-1234"), ShouldEqual, "call "+r.hash("555-1234"))
+		})
+
+		Convey("Then values keyed by a sensitive name are redacted in nested data", func() {
+			data := map[string]interface{}{
+				"apikey": "abc123",
+				"nested": map[string]interface{}{"path": "/x?token=y", "count": json.Number("3")},
+			}
+			r.value("data", data)
+			So(data["apikey"], ShouldEqual, r.hash("abc123"))
+			So(data["nested"].(map[string]interface{})["path"], ShouldEqual, "/x?token="+r.hash("y"))
+			So(data["nested"].(map[string]interface{})["count"], ShouldEqual, json.Number("3"))
+		})
+
+		Convey("Then hashes depend on the key", func() {
+			other, err := newRedactor("other", nil, nil, false)
+			So(err, ShouldBeNil)
+			So(other.hash("abc123"), ShouldNotEqual, r.hash("abc123"))
+		})
+
+		Convey("Then log events written through a redacting writer are redacted", func() {
+			var out bytes.Buffer
+			w := &redactingWriter{r, &out}
+			event := `{"event":"request","data":{"path":"/NDE2/a","query":"apikey=abc123"},"http":{"query":"postcode=SW1A%201AA&x=1","status_code":200}}` + "\n"
+			n, err := w.Write([]byte(event))
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(event))
+			So(out.String(), ShouldNotContainSubstring, "abc123")
+			So(out.String(), ShouldNotContainSubstring, "SW1A")
+			So(out.String(), ShouldContainSubstring, `"status_code":200`)
+			So(strings.Count(out.String(), "\n"), ShouldEqual, 1)
+		})
+	})
+
+	Convey("Invalid patterns are rejected", t, func() {
+		_, err := newRedactor("", nil, []string{"("}, false)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("A nil redactor leaves values unchanged", t, func() {
+		var r *redactor
+		So(r.uri("/a?apikey=b"), ShouldEqual, "/a?apikey=b")
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxTrackedReferrers bounds memory use if callers send random Referer headers
+const maxTrackedReferrers = 10000
+
+// otherReferrers is the domain hits are counted under once maxTrackedReferrers is reached
+const otherReferrers = "other"
+
+// referrerUsage summarises the requests to one rule from one referring page, or from
+// every page on a domain when the report is grouped by domain
+type referrerUsage struct {
+	Site   string `json:"site"`
+	Rule   string `json:"rule"`
+	Client string `json:"client"`
+	Domain string `json:"domain"`
+	Page   string `json:"page,omitempty"`
+	tally
+}
+
+type referrerKey struct {
+	site, rule, client, domain, page string
+}
+
+// referrerStats counts requests per legacy rule and referring page, to find external
+// sites still linking to legacy URLs
+type referrerStats struct {
+	hitCounts[referrerKey, referrerUsage, *referrerUsage]
+}
+
+var referrers = newReferrerStats()
+
+func newReferrerStats() *referrerStats {
+	s := &referrerStats{}
+	s.max = maxTrackedReferrers
+	s.overflow = func(key referrerKey) referrerKey {
+		return referrerKey{site: key.site, rule: key.rule, client: key.client, domain: otherReferrers}
+	}
+	return s
+}
+
+// referringPage returns the domain and page of a Referer header, without the query
+// string or fragment, or ok false if it isn't an http or https URL
+func referringPage(referer string) (domain, page string, ok bool) {
+	u, err := url.Parse(referer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return "", "", false
+	}
+	domain = normaliseHost(u.Host)
+	path := u.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	return domain, redaction.text(u.Scheme + "://" + domain + path), true
+}
+
+func (s *referrerStats) record(site, rule, client string, req *http.Request, at time.Time) {
+	domain, page, ok := referringPage(req.Referer())
+	if !ok {
+		return
+	}
+	s.count(referrerKey{site, rule, client, domain, page}, at, func(key referrerKey) *referrerUsage {
+		return &referrerUsage{Site: key.site, Rule: key.rule, Client: key.client, Domain: key.domain, Page: key.page}
+	}, nil)
+}
+
+// report returns the usage for every rule and referring page, or for every rule and
+// referring domain if byDomain is set, most hits first
+func (s *referrerStats) report(byDomain bool) []referrerUsage {
+	usage := s.list(nil)
+
+	if byDomain {
+		grouped := map[referrerKey]*referrerUsage{}
+		for _, u := range usage {
+			key := referrerKey{site: u.Site, rule: u.Rule, client: u.Client, domain: u.Domain}
+			g, ok := grouped[key]
+			if !ok {
+				g = &referrerUsage{Site: u.Site, Rule: u.Rule, Client: u.Client, Domain: u.Domain, tally: tally{FirstSeen: u.FirstSeen}}
+				grouped[key] = g
+			}
+			g.Hits += u.Hits
+			if u.FirstSeen.Before(g.FirstSeen) {
+				g.FirstSeen = u.FirstSeen
+			}
+			if u.LastSeen.After(g.LastSeen) {
+				g.LastSeen = u.LastSeen
+			}
+		}
+		usage = usage[:0]
+		for _, g := range grouped {
+			usage = append(usage, *g)
+		}
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i], usage[j]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		if a.Page != b.Page {
+			return a.Page < b.Page
+		}
+		if a.Site+"/"+a.Rule != b.Site+"/"+b.Rule {
+			return a.Site+"/"+a.Rule < b.Site+"/"+b.Rule
+		}
+		return a.Client < b.Client
+	})
+	return usage
+}
+
+func referrersReportHandler(w http.ResponseWriter, req *http.Request) {
+	usage := referrers.report(req.URL.Query().Get("by") == "domain")
+
+	rows := make([][]string, 0, len(usage))
+	for _, u := range usage {
+		rows = append(rows, []string{
+			u.Site,
+			u.Rule,
+			u.Client,
+			u.Domain,
+			u.Page,
+			strconv.FormatInt(u.Hits, 10),
+			u.FirstSeen.Format(time.RFC3339),
+			u.LastSeen.Format(time.RFC3339),
+		})
+	}
+	writeReport(w, req, usage, []string{"site", "rule", "client", "domain", "page", "hits", "first_seen", "last_seen"}, rows)
+}
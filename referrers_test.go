@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReferringPage(t *testing.T) {
+	Convey("Referring pages are reduced to their domain and path", t, func() {
+		domain, page, ok := referringPage("https://WWW.Example.com:443/stats/links.html?session=1#top")
+		So(ok, ShouldBeTrue)
+		So(domain, ShouldEqual, "www.example.com")
+		So(page, ShouldEqual, "https://www.example.com/stats/links.html")
+
+		_, page, ok = referringPage("http://example.com")
+		So(ok, ShouldBeTrue)
+		So(page, ShouldEqual, "http://example.com/")
+
+		for _, referer := range []string{"", "android-app://com.example", "/relative", "%zz"} {
+			_, _, ok = referringPage(referer)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestReferrerUsage(t *testing.T) {
+	Convey("Given requests to legacy URLs from linking pages", t, func() {
+		referrers = newReferrerStats()
+		defer func() { referrers = newReferrerStats() }()
+
+		router, err := newTestRouter(healthcheck.HealthCheck{}, defaultRules())
+		So(err, ShouldBeNil)
+
+		for _, r := range []struct{ target, referer string }{
+			{"http://neighbourhood.statistics.gov.uk/dissemination/", "https://council.example.gov.uk/stats.html?utm=1"},
+			{"http://neighbourhood.statistics.gov.uk/dissemination/", "https://council.example.gov.uk/stats.html"},
+			{"http://neighbourhood.statistics.gov.uk/dissemination/", "https://council.example.gov.uk/other.html"},
+			{"http://neighbourhood.statistics.gov.uk/dissemination/", "https://blog.example.org/"},
+			{"http://neighbourhood.statistics.gov.uk/dissemination/", ""},
+		} {
+			req := httptest.NewRequest("GET", r.target, nil)
+			if len(r.referer) > 0 {
+				req.Header.Set("Referer", r.referer)
+			}
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		Convey("Then hits are counted per rule and referring page", func() {
+			usage := referrers.report(false)
+			So(usage, ShouldHaveLength, 3)
+			So(usage[0].Page, ShouldEqual, "https://council.example.gov.uk/stats.html")
+			So(usage[0].Hits, ShouldEqual, 2)
+			So(usage[0].Site, ShouldNotBeEmpty)
+			So(usage[0].Rule, ShouldNotBeEmpty)
+		})
+
+		Convey("Then hits can be grouped by referring domain", func() {
+			usage := referrers.report(true)
+			So(usage, ShouldHaveLength, 2)
+			So(usage[0].Domain, ShouldEqual, "council.example.gov.uk")
+			So(usage[0].Hits, ShouldEqual, 3)
+			So(usage[0].Page, ShouldBeEmpty)
+		})
+
+		Convey("Then the admin report is served as CSV", func() {
+			w := httptest.NewRecorder()
+			getAdminRouter(nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/reports/referrers?format=csv&by=domain", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(rows, ShouldHaveLength, 3)
+			So(rows[0], ShouldResemble, []string{"site", "rule", "client", "domain", "page", "hits", "first_seen", "last_seen"})
+			So(rows[1][3], ShouldEqual, "council.example.gov.uk")
+		})
+	})
+
+	Convey("Given more distinct referring pages than are tracked", t, func() {
+		stats := newReferrerStats()
+		at := time.Now().UTC()
+		for i := 0; i < maxTrackedReferrers+3; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Referer", "https://example.com/"+strconv.Itoa(i))
+			stats.record("ness", "landing", clientBrowser, req, at)
+		}
+
+		Convey("Then the excess hits are counted together", func() {
+			usage := stats.report(false)
+			So(usage, ShouldHaveLength, maxTrackedReferrers+1)
+			So(usage[0].Domain, ShouldEqual, otherReferrers)
+			So(usage[0].Hits, ShouldEqual, 3)
+		})
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+var errNoRules = errors.New("no rule set has been loaded")
+
+// activeRules serves requests using the most recently loaded rule set, and records the
+// outcome of each reload for the health check and readiness endpoint
+type activeRules struct {
+	path string
+	// store, if set before the first reload, holds the rules instead of the file at path
+	store *ruleStore
+	// shadow, if set with comparisons before serving, is a candidate rule set each request
+	// is also evaluated against by compareShadows, without affecting the response
+	shadow      *activeRules
+	comparisons chan shadowComparison
+	// candidate marks the shadow rule set, which is audited with a shadow: source as it
+	// isn't served
+	candidate bool
+
+	mu          sync.RWMutex
+	rules       *ruleSet
+	handler     http.Handler
+	hosts       hostPatterns
+	loadedAt    time.Time
+	modTime     time.Time
+	reloadErr   error
+	reloadErrAt time.Time
+}
+
+// newActiveRules returns an activeRules loading from path, or serving the built-in rules
+// if path is empty. Nothing is served until the first call to reload or set.
+func newActiveRules(path string) *activeRules {
+	return &activeRules{path: path}
+}
+
+// reload loads the rule set from the store or disk and swaps it in if it is valid. On
+// failure the previous rule set, if any, continues to be served.
+func (a *activeRules) reload(ctx context.Context) error {
+	rules := defaultRules()
+	var modTime time.Time
+	if a.store != nil {
+		stored, err := a.store.current()
+		if err == nil && stored == nil {
+			err = errVersionNotFound
+		}
+		if err != nil {
+			return a.failed(ctx, err)
+		}
+		if rules, err = stored.ruleSet(); err != nil {
+			return a.failed(ctx, err)
+		}
+	} else if len(a.path) > 0 {
+		info, err := os.Stat(a.path)
+		if err != nil {
+			return a.failed(ctx, err)
+		}
+		modTime = info.ModTime()
+		if rules, err = loadRules(a.path); err != nil {
+			return a.failed(ctx, err)
+		}
+	}
+
+	previous := a.current()
+	if a.store == nil {
+		if err := a.auditReload(previous, rules); err != nil {
+			return a.failed(ctx, fmt.Errorf("rules not loaded as they couldn't be audited: %w", err))
+		}
+	}
+	if err := a.set(rules); err != nil {
+		return a.failed(ctx, err)
+	}
+
+	a.mu.Lock()
+	a.modTime = modTime
+	a.mu.Unlock()
+
+	log.Info(ctx, "loaded rules", log.Data{"version": rules.Version, "routes": rules.routeCount(), "rules_file": a.path})
+	return nil
+}
+
+// auditReload records loading rules from the rules file, or the built-in rules, and any
+// changes since the previous load. Rules in a store are audited when they are changed,
+// and shadow rules are recorded as such.
+func (a *activeRules) auditReload(previous, rules *ruleSet) error {
+	rec := auditRecord{Actor: "system", Action: auditLoad, Source: "builtin", Version: rules.Version}
+	if len(a.path) > 0 {
+		rec.Source = "file:" + a.path
+	}
+	if a.candidate {
+		rec.Source = "shadow:" + rec.Source
+	}
+	if previous != nil {
+		if rec.Changes = diffRules(previous, rules); len(rec.Changes) == 0 && previous.Version == rules.Version {
+			return nil
+		}
+		rec.Action = auditReload
+	}
+	return audit.record(rec)
+}
+
+// set serves rules from now on
+func (a *activeRules) set(rules *ruleSet) error {
+	h, err := rules.handler()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	a.handler = h
+	a.hosts = rules.servedHosts()
+	a.loadedAt = time.Now().UTC()
+	a.reloadErr = nil
+	return nil
+}
+
+// current returns the rule set being served, or nil if none has been loaded
+func (a *activeRules) current() *ruleSet {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.rules
+}
+
+// servesHost reports whether a site or alias in the rules being served names host
+func (a *activeRules) servesHost(host string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.hosts.matchHost(normaliseHost(host))
+}
+
+func (a *activeRules) failed(ctx context.Context, err error) error {
+	a.mu.Lock()
+	a.reloadErr = err
+	a.reloadErrAt = time.Now().UTC()
+	a.mu.Unlock()
+
+	log.Error(ctx, "failed to reload rules", err, log.Data{"rules_file": a.path})
+	return err
+}
+
+// changed reports whether the rules file has been modified since it was last loaded.
+// Rules in a store are reloaded when they are changed, so are never reported as changed.
+func (a *activeRules) changed() bool {
+	if len(a.path) == 0 || a.store != nil {
+		return false
+	}
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.rules == nil || !info.ModTime().Equal(a.modTime)
+}
+
+// watch reloads the rules on SIGHUP, and whenever the rules file changes or the last
+// load from the file or store failed, checking every interval, until ctx is cancelled
+func (a *activeRules) watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 && (len(a.path) > 0 || a.store != nil) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info(ctx, "reloading rules on SIGHUP")
+			_ = a.reload(ctx)
+		case <-tick:
+			a.mu.RLock()
+			retry := a.reloadErr != nil
+			a.mu.RUnlock()
+			if retry || a.changed() {
+				_ = a.reload(ctx)
+			}
+		}
+	}
+}
+
+func (a *activeRules) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	a.mu.RLock()
+	h := a.handler
+	a.mu.RUnlock()
+
+	if h == nil {
+		if !shadowing(req) {
+			log.Error(req.Context(), "unable to serve request", errNoRules)
+		}
+		recordFor(req).Outcome = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if a.shadow == nil || a.comparisons == nil || a.shadow.current() == nil {
+		h.ServeHTTP(w, req)
+		return
+	}
+
+	req, record := withRecord(req)
+	rec := &responseRecorder{ResponseWriter: w}
+	h.ServeHTTP(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	a.queueShadow(req, record, rec.status, rec.Header().Get("Location"))
+}
+
+// rulesStatus summarises the active rule set for the health check and readiness endpoint
+type rulesStatus struct {
+	Ready       bool       `json:"ready"`
+	Version     string     `json:"version,omitempty"`
+	Routes      int        `json:"routes"`
+	LoadedAt    *time.Time `json:"loaded_at,omitempty"`
+	ReloadError string     `json:"reload_error,omitempty"`
+	ReloadErrAt *time.Time `json:"reload_error_at,omitempty"`
+}
+
+func (a *activeRules) status() rulesStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	s := rulesStatus{Ready: a.rules != nil}
+	if a.rules != nil {
+		loadedAt := a.loadedAt
+		s.Version = a.rules.Version
+		s.Routes = a.rules.routeCount()
+		s.LoadedAt = &loadedAt
+	}
+	if a.reloadErr != nil {
+		errAt := a.reloadErrAt
+		s.ReloadError = a.reloadErr.Error()
+		s.ReloadErrAt = &errAt
+	}
+	return s
+}
+
+// check implements healthcheck.Checker. It is critical until a rule set has been loaded,
+// and warns if the most recent reload failed while an older rule set is still served.
+func (a *activeRules) check(ctx context.Context, state *healthcheck.CheckState) error {
+	s := a.status()
+	switch {
+	case !s.Ready:
+		return state.Update(healthcheck.StatusCritical, fmt.Sprintf("%s: %s", errNoRules, s.ReloadError), 0)
+	case len(s.ReloadError) > 0:
+		return state.Update(healthcheck.StatusWarning, fmt.Sprintf("serving rules version %s (%d routes) loaded at %s; reload failed at %s: %s",
+			s.Version, s.Routes, s.LoadedAt.Format(time.RFC3339), s.ReloadErrAt.Format(time.RFC3339), s.ReloadError), 0)
+	default:
+		return state.Update(healthcheck.StatusOK, fmt.Sprintf("serving rules version %s (%d routes) loaded at %s",
+			s.Version, s.Routes, s.LoadedAt.Format(time.RFC3339)), 0)
+	}
+}
+
+// readyHandler responds with 200 once a rule set has been loaded, and 503 before then
+// or while the service is draining
+func (a *activeRules) readyHandler(w http.ResponseWriter, req *http.Request) {
+	s := a.status()
+	if draining.Load() {
+		s.Ready = false
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Error(req.Context(), "error writing response", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testRulesJSON = `{"version":"%s","sites":[{"name":"x","routes":[{"id":"x","path":"/{uri:.*}","handler":"gone"}]}]}`
+
+func TestActiveRules(t *testing.T) {
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	hc := healthcheck.New(versionInfo, time.Second*10, time.Minute)
+	ctx := context.Background()
+
+	Convey("Given a rules file that doesn't exist yet", t, func() {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		active := newActiveRules(path)
+		router := getRouter(&hc, active)
+
+		get := func(url string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+			return w
+		}
+
+		So(active.reload(ctx), ShouldNotBeNil)
+
+		Convey("Then the service is not ready and the check is critical", func() {
+			So(get("/ready").Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(get("/a").Code, ShouldEqual, http.StatusServiceUnavailable)
+
+			state := healthcheck.NewCheckState("rules")
+			So(active.check(ctx, state), ShouldBeNil)
+			So(state.Status(), ShouldEqual, healthcheck.StatusCritical)
+		})
+
+		Convey("When a valid rules file is written and reloaded", func() {
+			So(os.WriteFile(path, []byte(fmt.Sprintf(testRulesJSON, "v1")), 0600), ShouldBeNil)
+			So(active.changed(), ShouldBeTrue)
+			So(active.reload(ctx), ShouldBeNil)
+
+			Convey("Then the service is ready and serves the rules", func() {
+				w := get("/ready")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldContainSubstring, `"version":"v1"`)
+				So(get("/a").Code, ShouldEqual, http.StatusGone)
+				So(active.changed(), ShouldBeFalse)
+
+				state := healthcheck.NewCheckState("rules")
+				So(active.check(ctx, state), ShouldBeNil)
+				So(state.Status(), ShouldEqual, healthcheck.StatusOK)
+				So(state.Message(), ShouldContainSubstring, "version v1 (1 routes)")
+			})
+
+			Convey("And a later reload fails", func() {
+				So(os.WriteFile(path, []byte(`{"sites":[]}`), 0600), ShouldBeNil)
+				So(active.reload(ctx), ShouldNotBeNil)
+
+				Convey("Then the previous rules are still served and the failure is reported", func() {
+					So(get("/ready").Code, ShouldEqual, http.StatusOK)
+					So(get("/a").Code, ShouldEqual, http.StatusGone)
+					So(active.status().ReloadError, ShouldContainSubstring, "no sites")
+
+					state := healthcheck.NewCheckState("rules")
+					So(active.check(ctx, state), ShouldBeNil)
+					So(state.Status(), ShouldEqual, healthcheck.StatusWarning)
+				})
+			})
+
+			Convey("And the service starts draining", func() {
+				draining.Store(true)
+				Reset(func() { draining.Store(false) })
+				So(get("/ready").Code, ShouldEqual, http.StatusServiceUnavailable)
+			})
+		})
+	})
+
+	Convey("Given rules served from a store that is empty when the service starts", t, func() {
+		store, err := openRuleStore(filepath.Join(t.TempDir(), "rules.db"))
+		So(err, ShouldBeNil)
+		defer store.Close()
+		active := newActiveRules("")
+		active.store = store
+		So(active.reload(ctx), ShouldWrap, errVersionNotFound)
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go active.watch(ctx, time.Millisecond*10)
+
+		Convey("When the store is seeded", func() {
+			_, err := seedRuleStore(store, "")
+			So(err, ShouldBeNil)
+
+			Convey("Then the failed load is retried and the rules are served", func() {
+				So(waitFor(func() bool { return active.status().Ready }), ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	"github.com/ONSdigital/dp-legacy-redirector/config"
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+// Log formats understood by the replay command
+const (
+	replayAuto     = "auto"
+	replayALB      = "alb"
+	replayCombined = "combined"
+	replayURLs     = "urls"
+)
+
+// errDifferences is returned by the replay command when the rule sets disagree, so that
+// it exits with a distinct status
+var errDifferences = errors.New("rule sets differ")
+
+// replayRequest is a request read from a log
+type replayRequest struct {
+	method    string
+	url       string
+	userAgent string
+}
+
+// replayResult is what a rule set did with a request
+type replayResult struct {
+	status   int
+	location string
+}
+
+// parseLogLine reads a request from a line of an ALB access log, a Combined Log Format
+// access log (optionally followed by the host, as written by this service) or a list of
+// URLs. Paths without a host are requested from defaultHost.
+func parseLogLine(line, format, defaultHost string) (replayRequest, bool) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return replayRequest{}, false
+	}
+
+	if format == replayAuto {
+		switch {
+		case strings.HasPrefix(line, "/") || strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://"):
+			format = replayURLs
+		case strings.Contains(line, `] "`):
+			format = replayCombined
+		default:
+			format = replayALB
+		}
+	}
+
+	fields := splitLogFields(line)
+	var r replayRequest
+	switch format {
+	case replayURLs:
+		r = replayRequest{method: http.MethodGet, url: line}
+	case replayALB:
+		// type time elb client target request_time target_time response_time elb_status
+		// target_status received sent "request" "user_agent" ...
+		if len(fields) < 14 {
+			return replayRequest{}, false
+		}
+		method, target, ok := parseRequestLine(fields[12])
+		if !ok {
+			return replayRequest{}, false
+		}
+		r = replayRequest{method: method, url: target, userAgent: fields[13]}
+	case replayCombined:
+		// client ident user [time zone] "request" status bytes "referrer" "user_agent" host
+		if len(fields) < 6 {
+			return replayRequest{}, false
+		}
+		i := 3
+		for i < len(fields) && !strings.HasSuffix(fields[i], "]") {
+			i++
+		}
+		if i+1 >= len(fields) {
+			return replayRequest{}, false
+		}
+		method, target, ok := parseRequestLine(fields[i+1])
+		if !ok {
+			return replayRequest{}, false
+		}
+		r = replayRequest{method: method, url: target}
+		if len(fields) > i+5 {
+			r.userAgent = fields[i+5]
+		}
+		if len(fields) > i+6 && fields[i+6] != "-" && strings.HasPrefix(target, "/") {
+			r.url = "http://" + fields[i+6] + target
+		}
+	default:
+		return replayRequest{}, false
+	}
+
+	if r.userAgent == "-" {
+		r.userAgent = ""
+	}
+	if strings.HasPrefix(r.url, "/") {
+		r.url = "http://" + defaultHost + r.url
+	}
+	if u, err := url.Parse(r.url); err != nil || len(u.Host) == 0 {
+		return replayRequest{}, false
+	}
+	return r, true
+}
+
+// parseRequestLine splits an HTTP request line such as "GET /a HTTP/1.1" into its
+// method and target
+func parseRequestLine(s string) (method, target string, ok bool) {
+	parts := strings.Fields(s)
+	if len(parts) < 2 || parts[0] == "-" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// splitLogFields splits line on spaces, keeping double quoted fields (without their
+// quotes) together
+func splitLogFields(line string) []string {
+	var fields []string
+	for len(line) > 0 {
+		line = strings.TrimLeft(line, " ")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == '"' {
+			end := 1
+			for end < len(line) && (line[end] != '"' || line[end-1] == '\\') {
+				end++
+			}
+			fields = append(fields, line[1:min(end, len(line))])
+			line = line[min(end+1, len(line)):]
+			continue
+		}
+		field, rest, _ := strings.Cut(line, " ")
+		fields = append(fields, field)
+		line = rest
+	}
+	return fields
+}
+
+// replayer serves requests with a rule set and records the responses
+type replayer struct {
+	router http.Handler
+}
+
+func newReplayer(path string) (*replayer, error) {
+	rules := defaultRules()
+	if len(path) > 0 && path != "builtin" {
+		var err error
+		if rules, err = loadRules(path); err != nil {
+			return nil, err
+		}
+	}
+
+	active := newActiveRules("")
+	if err := active.set(rules); err != nil {
+		return nil, err
+	}
+	return &replayer{router: getRouter(&healthcheck.HealthCheck{}, active)}, nil
+}
+
+func (rp *replayer) serve(r replayRequest) replayResult {
+	req, err := http.NewRequest(r.method, r.url, nil)
+	if err != nil {
+		return replayResult{status: http.StatusBadRequest}
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = "192.0.2.1:1234"
+	if len(r.userAgent) > 0 {
+		req.Header.Set("User-Agent", r.userAgent)
+	}
+
+	resp := &shadowResponse{header: http.Header{}}
+	rp.router.ServeHTTP(resp, req)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return replayResult{status: resp.status, location: resp.header.Get("Location")}
+}
+
+// openLog opens a log file, decompressing it if its name ends in .gz. - is stdin.
+func openLog(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// replayCommand replays requests from access logs against two rule sets and writes
+// every request whose status or Location differs as CSV. Destinations are checked and
+// user agents classified using the service configuration, as they would be when serving.
+//
+// Repeated requests are replayed once and counted, remembering up to -distinct requests
+// at a time; when that many have been seen they are written and forgotten, so a request
+// seen again afterwards is reported again.
+func replayCommand(cfg *config.Config, args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	oldRules := fs.String("old", "builtin", "rules file to compare from, or builtin")
+	newRules := fs.String("new", "builtin", "rules file to compare to, or builtin")
+	format := fs.String("format", replayAuto, "log format: auto, alb, combined or urls")
+	host := fs.String("host", "neighbourhood.statistics.gov.uk", "host for logged paths without one")
+	all := fs.Bool("all", false, "write every request's result, not just differences, to compare builds")
+	maxDistinct := fs.Int("distinct", 100000, "how many distinct requests to remember before writing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 || *maxDistinct < 1 {
+		return flag.ErrHelp
+	}
+
+	var err error
+	log.SetDestination(io.Discard, io.Discard)
+	defer log.SetDestination(os.Stdout, os.Stderr)
+
+	destinations = newDestinationPolicy(cfg.AllowedRedirectHosts, cfg.AllowedRedirectSchemes)
+	if clients, err = newClassifier(cfg.UserAgentPatterns); err != nil {
+		return err
+	}
+
+	from, err := newReplayer(*oldRules)
+	if err != nil {
+		return fmt.Errorf("old rules: %w", err)
+	}
+	to, err := newReplayer(*newRules)
+	if err != nil {
+		return fmt.Errorf("new rules: %w", err)
+	}
+
+	type outcome struct {
+		from, to replayResult
+		count    int
+	}
+	seen := map[replayRequest]*outcome{}
+	var lines, skipped, distinct, changed int
+
+	w := csv.NewWriter(stdout)
+	_ = w.Write([]string{"method", "url", "user_agent", "count", "old_status", "new_status", "old_location", "new_location"})
+	// flush writes the requests seen so far in order and forgets them
+	flush := func() error {
+		requests := make([]replayRequest, 0, len(seen))
+		for r := range seen {
+			requests = append(requests, r)
+		}
+		sort.Slice(requests, func(i, j int) bool {
+			a, b := requests[i], requests[j]
+			if a.url != b.url {
+				return a.url < b.url
+			}
+			if a.method != b.method {
+				return a.method < b.method
+			}
+			return a.userAgent < b.userAgent
+		})
+
+		for _, r := range requests {
+			o := seen[r]
+			if o.from != o.to {
+				changed++
+			} else if !*all {
+				continue
+			}
+			_ = w.Write([]string{r.method, r.url, r.userAgent, strconv.Itoa(o.count),
+				strconv.Itoa(o.from.status), strconv.Itoa(o.to.status), o.from.location, o.to.location})
+		}
+		distinct += len(seen)
+		clear(seen)
+		w.Flush()
+		return w.Error()
+	}
+
+	for _, path := range fs.Args() {
+		f, err := openLog(path)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			lines++
+			r, ok := parseLogLine(scanner.Text(), *format, *host)
+			if !ok {
+				skipped++
+				continue
+			}
+			if o, ok := seen[r]; ok {
+				o.count++
+				continue
+			}
+			seen[r] = &outcome{from: from.serve(r), to: to.serve(r), count: 1}
+			if len(seen) >= *maxDistinct {
+				if err := flush(); err != nil {
+					f.Close()
+					return err
+				}
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stderr, "%d lines, %d skipped, %d distinct requests, %d changed\n", lines, skipped, distinct, changed)
+	if changed > 0 {
+		return errDifferences
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseLogLine(t *testing.T) {
+	Convey("Requests are read from each log format", t, func() {
+		for line, want := range map[string]replayRequest{
+			`https 2024-01-01T00:00:00.000000Z app/legacy/abc 198.51.100.1:1234 10.0.0.1:80 0.000 0.001 0.000 307 307 120 300 "GET https://neighbourhood.statistics.gov.uk:443/HTMLDocs/a.html?x=1 HTTP/1.1" "Mozilla/5.0 (X11)" ECDHE TLSv1.2 arn - "Root=1" "neighbourhood.statistics.gov.uk" "-" 0 2024-01-01T00:00:00Z "forward" "-" "-" "10.0.0.1:80" "307" "-" "-"`: {
+				method: "GET", url: "https://neighbourhood.statistics.gov.uk:443/HTMLDocs/a.html?x=1", userAgent: "Mozilla/5.0 (X11)",
+			},
+			`198.51.100.1 - - [01/Jan/2024:00:00:00 +0000] "GET /ons/api/x HTTP/1.1" 410 52 "-" "curl/8.0" web.ons.gov.uk wda-api gone 0.102 api-client`: {
+				method: "GET", url: "http://web.ons.gov.uk/ons/api/x", userAgent: "curl/8.0",
+			},
+			`198.51.100.1 - - [01/Jan/2024:00:00:00 +0000] "HEAD /HTMLDocs/b HTTP/1.1" 307 - "-" "-"`: {
+				method: "HEAD", url: "http://neighbourhood.statistics.gov.uk/HTMLDocs/b",
+			},
+			`https://visual.ons.gov.uk/some-article/`: {method: "GET", url: "https://visual.ons.gov.uk/some-article/"},
+			`/NDE2/Disco/GetAreas`:                    {method: "GET", url: "http://neighbourhood.statistics.gov.uk/NDE2/Disco/GetAreas"},
+		} {
+			r, ok := parseLogLine(line, replayAuto, "neighbourhood.statistics.gov.uk")
+			So(ok, ShouldBeTrue)
+			So(r, ShouldResemble, want)
+		}
+	})
+
+	Convey("Blank, comment and malformed lines are skipped", t, func() {
+		for _, line := range []string{"", "# urls", "not a log line", `198.51.100.1 - - [01/Jan/2024:00:00:00 +0000] "-" 400 0 "-" "-"`} {
+			_, ok := parseLogLine(line, replayAuto, "example.com")
+			So(ok, ShouldBeFalse)
+		}
+	})
+}
+
+func TestReplayCommand(t *testing.T) {
+	Convey("Given a log and a candidate rule set retiring NeSS pages", t, func() {
+		dir := t.TempDir()
+		logPath := filepath.Join(dir, "urls.log")
+		So(os.WriteFile(logPath, []byte("/HTMLDocs/a\n/HTMLDocs/a\n/NDE2/b\nhttps://visual.ons.gov.uk/\nnonsense\n"), 0600), ShouldBeNil)
+		rulesPath := filepath.Join(dir, "rules.json")
+		So(os.WriteFile(rulesPath, []byte(`{"version": "next", "sites": [
+			{"name": "ness", "hosts": ["neighbourhood.statistics.gov.uk"], "routes": [{"id": "ness-all", "path": "/{uri:.*}", "handler": "gone"}]},
+			{"name": "default", "routes": [{"id": "catch-all", "path": "/{uri:.*}", "handler": "visual-article"}]}
+		]}`), 0600), ShouldBeNil)
+
+		var stdout, stderr bytes.Buffer
+
+		Convey("When it is replayed against the built-in rules", func() {
+			code := runCommand([]string{"replay", "-new", rulesPath, logPath}, &stdout, &stderr)
+
+			Convey("Then the changed requests are reported and it exits with status 2", func() {
+				So(code, ShouldEqual, 2)
+				rows, err := csv.NewReader(&stdout).ReadAll()
+				So(err, ShouldBeNil)
+				So(rows, ShouldHaveLength, 2)
+				So(rows[1][:6], ShouldResemble, []string{"GET", "http://neighbourhood.statistics.gov.uk/HTMLDocs/a", "", "2", "307", "410"})
+				So(rows[1][6], ShouldEqual, "https://www.ons.gov.uk/visualisations/nesscontent/a")
+				So(rows[1][7], ShouldBeEmpty)
+				So(stderr.String(), ShouldContainSubstring, "5 lines, 1 skipped, 3 distinct requests, 1 changed")
+			})
+		})
+
+		Convey("When fewer distinct requests are remembered than the log has", func() {
+			code := runCommand([]string{"replay", "-distinct", "1", "-new", rulesPath, logPath}, &stdout, &stderr)
+
+			Convey("Then repeated requests are reported each time they are forgotten", func() {
+				So(code, ShouldEqual, 2)
+				rows, err := csv.NewReader(&stdout).ReadAll()
+				So(err, ShouldBeNil)
+				So(rows, ShouldHaveLength, 3)
+				So(rows[1][:4], ShouldResemble, []string{"GET", "http://neighbourhood.statistics.gov.uk/HTMLDocs/a", "", "1"})
+				So(rows[2][:4], ShouldResemble, rows[1][:4])
+				So(stderr.String(), ShouldContainSubstring, "5 lines, 1 skipped, 4 distinct requests, 2 changed")
+			})
+		})
+
+		Convey("When it is replayed against the same rules", func() {
+			code := runCommand([]string{"replay", "-all", logPath}, &stdout, &stderr)
+
+			Convey("Then every result is written and it succeeds", func() {
+				So(code, ShouldEqual, 0)
+				rows, err := csv.NewReader(&stdout).ReadAll()
+				So(err, ShouldBeNil)
+				So(rows, ShouldHaveLength, 4)
+			})
+		})
+	})
+}
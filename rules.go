@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ruleSet describes the legacy sites handled by the redirector and the routes served for each.
+// Its responses apply to any site or host that doesn't set its own.
+type ruleSet struct {
+	Version string            `json:"version"`
+	Aliases map[string]string `json:"aliases,omitempty"`
+	Sites   []site            `json:"sites"`
+	responses
+}
+
+// responses holds the landing page users are redirected to and the message returned
+// with a 410 for retired APIs, with translations keyed by language. Empty values are
+// inherited.
+type responses struct {
+	LandingPage string               `json:"landing_page,omitempty"`
+	GoneMessage string               `json:"gone_message,omitempty"`
+	Languages   map[string]responses `json:"languages,omitempty"`
+}
+
+// site is a legacy system, matched by one or more host patterns. A site with no
+// hosts matches any host.
+//
+// Host patterns are either exact host names, wildcards where each * matches a
+// single DNS label or part of one (e.g. *.neighbourhood.statistics.gov.uk or
+// ness-*.neighbourhood.statistics.gov.uk), or regular expressions prefixed with ~
+//
+// HostResponses overrides the site's responses for individual hosts.
+//
+// Redirects maps article slugs to the destinations the visual-article handler redirects
+// them to. A site without redirects uses the built-in visual.ons.gov.uk table.
+type site struct {
+	Name          string               `json:"name"`
+	Hosts         []string             `json:"hosts,omitempty"`
+	Routes        []route              `json:"routes"`
+	HostResponses map[string]responses `json:"host_responses,omitempty"`
+	Redirects     map[string]string    `json:"redirects,omitempty"`
+	responses
+}
+
+// articleRedirects returns the site's redirects table, or the built-in one if it has none
+func (s site) articleRedirects() map[string]string {
+	if s.Redirects == nil {
+		return visualRedirects
+	}
+	return s.Redirects
+}
+
+// route maps a gorilla/mux path template to one of the redirector's handlers, or to
+// a destination computed by an expression (see exprEnv). Routes with conditions, an
+// If expression or an effective period only match requests meeting them, so a
+// conditional route should come before the fallback route for the same path.
+type route struct {
+	ID            string      `json:"id"`
+	Path          string      `json:"path"`
+	Handler       string      `json:"handler,omitempty"`
+	Destination   string      `json:"destination,omitempty"`
+	When          *conditions `json:"when,omitempty"`
+	If            string      `json:"if,omitempty"`
+	EffectiveFrom *time.Time  `json:"effective_from,omitempty"`
+	ExpiresAt     *time.Time  `json:"expires_at,omitempty"`
+	Canary        *canary     `json:"canary,omitempty"`
+}
+
+var handlers = map[string]http.HandlerFunc{
+	"landing":        defaultHandler,
+	"ness-content":   dataVisHandler,
+	"gone":           apiHandler,
+	"visual-asset":   visualAssetHandler,
+	"visual-article": visualArticleHandler,
+}
+
+// defaultRules returns the rule set used when no rules file is configured
+func defaultRules() *ruleSet {
+	return &ruleSet{
+		Version: "builtin",
+		Sites: []site{
+			{
+				Name:  "ness",
+				Hosts: []string{"neighbourhood.statistics.gov.uk", "*.neighbourhood.statistics.gov.uk"},
+				Routes: []route{
+					{ID: "ness-website", Path: "/HTMLDocs/{uri:.*}", Handler: "ness-content"},
+					{ID: "ness-api", Path: "/NDE2/{uri:.*}", Handler: "gone"},
+				},
+			},
+			{
+				Name:  "wda",
+				Hosts: []string{"web.ons.gov.uk"},
+				Routes: []route{
+					{ID: "wda-website", Path: "/ons/apiservice/web/{uri:.*}", Handler: "landing"},
+					{ID: "wda-apiservice", Path: "/ons/apiservice/{uri:.*}", Handler: "gone"},
+					{ID: "wda-api", Path: "/ons/api/{uri:.*}", Handler: "gone"},
+				},
+			},
+			{
+				Name:  "wda-data",
+				Hosts: []string{"data.ons.gov.uk"},
+				Routes: []route{
+					{ID: "wda-data-api", Path: "/{uri:.*}", Handler: "gone"},
+				},
+			},
+			{
+				Name:  "visual",
+				Hosts: []string{"visual.ons.gov.uk"},
+				Routes: []route{
+					{ID: "visual-uploads", Path: "/wp-content/uploads/{uri:.*}", Handler: "visual-asset"},
+					{ID: "visual-article", Path: "/{article:[^/]*}{uri:/?.*}", Handler: "visual-article"},
+				},
+			},
+			{
+				Name: "default",
+				Routes: []route{
+					{ID: "catch-all", Path: "/{uri:.*}", Handler: "landing"},
+				},
+			},
+		},
+	}
+}
+
+// loadRules reads and validates a JSON rule set, or a signed bundle of one, from path
+func loadRules(path string) (*ruleSet, error) {
+	rs, _, err := readRules(path)
+	return rs, err
+}
+
+// readRules reads and validates the rules at path like loadRules, also returning the
+// signed bundle they came from, if they were signed
+func readRules(path string) (*ruleSet, json.RawMessage, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rs, err := ruleSigning.decode(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+	return rs, signedBundle(b), nil
+}
+
+// validate checks that every host pattern compiles, every route names a known
+// handler and route IDs are unique
+func (rs *ruleSet) validate() error {
+	if len(rs.Sites) == 0 {
+		return errors.New("rule set has no sites")
+	}
+
+	if err := rs.responses.validate(); err != nil {
+		return err
+	}
+
+	ids := map[string]bool{}
+	for _, s := range rs.Sites {
+		if _, err := compileHostPatterns(s.Hosts); err != nil {
+			return fmt.Errorf("site %s: %w", s.Name, err)
+		}
+		if err := s.responses.validate(); err != nil {
+			return fmt.Errorf("site %s: %w", s.Name, err)
+		}
+		for host, r := range s.HostResponses {
+			if err := r.validate(); err != nil {
+				return fmt.Errorf("site %s: host %s: %w", s.Name, host, err)
+			}
+		}
+		for slug, dest := range s.Redirects {
+			if err := validateRedirect(slug, dest); err != nil {
+				return fmt.Errorf("site %s: redirect %s: %w", s.Name, slug, err)
+			}
+		}
+		for _, r := range s.Routes {
+			if len(r.ID) == 0 {
+				return fmt.Errorf("site %s: route %s has no id", s.Name, r.Path)
+			}
+			if ids[r.ID] {
+				return fmt.Errorf("site %s: duplicate route id %s", s.Name, r.ID)
+			}
+			ids[r.ID] = true
+			if !strings.HasPrefix(r.Path, "/") {
+				return fmt.Errorf("site %s: route %s path must start with /", s.Name, r.ID)
+			}
+			if _, err := r.compile(); err != nil {
+				return fmt.Errorf("site %s: %w", s.Name, err)
+			}
+		}
+	}
+	for alias, canonical := range rs.Aliases {
+		if len(alias) == 0 || len(canonical) == 0 {
+			return errors.New("aliases must map a host to a non-empty canonical host")
+		}
+	}
+	return nil
+}
+
+// validateRedirect checks that slug is a single path segment and dest an absolute URL
+func validateRedirect(slug, dest string) error {
+	if len(slug) == 0 || strings.Contains(slug, "/") {
+		return errors.New("slug must be a single, non-empty path segment")
+	}
+	if u, err := url.Parse(dest); err != nil || !u.IsAbs() || len(u.Host) == 0 {
+		return fmt.Errorf("destination %q must be an absolute URL", dest)
+	}
+	return nil
+}
+
+func (r responses) validate() error {
+	for lang, translated := range r.Languages {
+		if _, ok := catalogues[lang]; !ok || lang == english {
+			return fmt.Errorf("unsupported language %q", lang)
+		}
+		if len(translated.Languages) > 0 {
+			return fmt.Errorf("language %s: translations can't be nested", lang)
+		}
+		if err := translated.validate(); err != nil {
+			return fmt.Errorf("language %s: %w", lang, err)
+		}
+	}
+
+	if len(r.LandingPage) == 0 {
+		return nil
+	}
+	u, err := url.Parse(r.LandingPage)
+	if err != nil || !u.IsAbs() || len(u.Host) == 0 {
+		return fmt.Errorf("landing page %q must be an absolute URL", r.LandingPage)
+	}
+	return nil
+}
+
+// inherit returns r with any empty values, including translations, taken from parent
+func (r responses) inherit(parent responses) responses {
+	own := len(r.LandingPage) > 0 && r.LandingPage != parent.LandingPage
+	if len(r.LandingPage) == 0 {
+		r.LandingPage = parent.LandingPage
+	}
+	if len(r.GoneMessage) == 0 {
+		r.GoneMessage = parent.GoneMessage
+	}
+
+	if len(parent.Languages) > 0 {
+		languages := make(map[string]responses, len(parent.Languages))
+		for lang, translated := range parent.Languages {
+			// A translation of the parent's landing page isn't one of this landing page
+			if own {
+				translated.LandingPage = ""
+			}
+			languages[lang] = r.Languages[lang].inherit(translated)
+		}
+		for lang, translated := range r.Languages {
+			if _, ok := languages[lang]; !ok {
+				languages[lang] = translated
+			}
+		}
+		r.Languages = languages
+	}
+	return r
+}
+
+// routeCount returns the number of routes across all sites
+func (rs *ruleSet) routeCount() int {
+	n := 0
+	for _, s := range rs.Sites {
+		n += len(s.Routes)
+	}
+	return n
+}
+
+// hostPatterns matches a request host against a list of compiled host patterns
+type hostPatterns []*regexp.Regexp
+
+func compileHostPatterns(patterns []string) (hostPatterns, error) {
+	var compiled hostPatterns
+	for _, p := range patterns {
+		var expr string
+		switch {
+		case strings.HasPrefix(p, "~"):
+			// hosts are matched once lowercased, so expressions written in any case match
+			expr = p[1:]
+			if !strings.HasPrefix(expr, "^") {
+				expr = "^(?:" + expr + ")$"
+			}
+			expr = "(?i)" + expr
+		case len(p) == 0:
+			return nil, errors.New("empty host pattern")
+		default:
+			parts := strings.Split(strings.ToLower(p), "*")
+			for i := range parts {
+				parts[i] = regexp.QuoteMeta(parts[i])
+			}
+			expr = "^" + strings.Join(parts, "[a-z0-9-]+") + "$"
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// match implements mux.MatcherFunc. An empty list of patterns matches any host.
+func (hp hostPatterns) match(req *http.Request, _ *mux.RouteMatch) bool {
+	return len(hp) == 0 || hp.matchHost(normaliseHost(req.Host))
+}
+
+// matchHost reports whether any pattern matches a normalised host
+func (hp hostPatterns) matchHost(host string) bool {
+	for _, re := range hp {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// exactHosts returns the host names in patterns that aren't wildcards or regexps
+func exactHosts(patterns []string) []string {
+	var names []string
+	for _, p := range patterns {
+		if !strings.HasPrefix(p, "~") && !strings.Contains(p, "*") {
+			names = append(names, strings.ToLower(p))
+		}
+	}
+	return names
+}
+
+// servedHosts returns patterns matching the hosts named by the rule set's sites and
+// aliases. Sites with no hosts, which match any host, aren't included.
+func (rs *ruleSet) servedHosts() hostPatterns {
+	var hp hostPatterns
+	for _, s := range rs.Sites {
+		compiled, _ := compileHostPatterns(s.Hosts)
+		hp = append(hp, compiled...)
+	}
+	for _, alias := range sortedKeys(rs.Aliases) {
+		hp = append(hp, regexp.MustCompile("^"+regexp.QuoteMeta(normaliseHost(alias))+"$"))
+	}
+	return hp
+}
+
+// handler returns a router serving the routes for every site in rs
+func (rs *ruleSet) handler() (http.Handler, error) {
+	routes, err := rs.routes()
+	if err != nil {
+		return nil, err
+	}
+	return aliasHosts(rs.Aliases, newRouteMatcher(routes)), nil
+}
+
+// routes compiles the routes for every site in rs, in precedence order
+func (rs *ruleSet) routes() ([]*matchRoute, error) {
+	var routes []*matchRoute
+	defaults := rs.responses.inherit(responses{LandingPage: landingPage, GoneMessage: apiResponse})
+
+	for _, s := range rs.Sites {
+		hosts, err := compileHostPatterns(s.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", s.Name, err)
+		}
+
+		sc := &siteContext{
+			name:      s.Name,
+			responses: s.responses.inherit(defaults),
+			hosts:     make(map[string]responses, len(s.HostResponses)),
+			redirects: s.articleRedirects(),
+		}
+		for host, r := range s.HostResponses {
+			sc.hosts[normaliseHost(host)] = r.inherit(sc.responses)
+		}
+
+		for _, r := range s.Routes {
+			cr, err := r.compile()
+			if err != nil {
+				return nil, fmt.Errorf("site %s: %w", s.Name, err)
+			}
+			routes = append(routes, &matchRoute{
+				order:   len(routes),
+				id:      r.ID,
+				hosts:   hosts,
+				exact:   exactHosts(s.Hosts),
+				path:    cr.path,
+				route:   cr,
+				handler: sc.wrap(r.ID, cr.handler),
+			})
+		}
+	}
+	return routes, nil
+}
+
+// compiledRoute is a route's path template, handler and conditions, ready to be matched
+type compiledRoute struct {
+	path    *pathTemplate
+	handler http.HandlerFunc
+	when    *compiledConditions
+	cond    *exprCondition
+	window  *activeWindow
+}
+
+// compile looks up or builds the route's handler and compiles its path template and
+// conditions, so that errors in templates and expressions fail validation rather than
+// requests
+func (r route) compile() (*compiledRoute, error) {
+	path, err := compilePath(r.Path)
+	if err != nil {
+		return nil, fmt.Errorf("route %s path: %w", r.ID, err)
+	}
+	h, err := resolveHandler(r.Handler, r.Destination)
+	if err != nil {
+		return nil, fmt.Errorf("route %s %w", r.ID, err)
+	}
+	cr := &compiledRoute{path: path, handler: h}
+
+	if r.Canary != nil {
+		candidate, err := resolveHandler(r.Canary.Handler, r.Canary.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("route %s canary %w", r.ID, err)
+		}
+		if r.Canary.Percent < 0 || r.Canary.Percent > 100 {
+			return nil, fmt.Errorf("route %s canary percent must be between 0 and 100", r.ID)
+		}
+		cr.handler = canaryHandler(r.ID, r.Canary.Percent, h, candidate)
+	}
+
+	if cr.when, err = r.When.compile(); err != nil {
+		return nil, fmt.Errorf("route %s: %w", r.ID, err)
+	}
+	if len(r.If) > 0 {
+		if cr.cond, err = newExprCondition(r.If); err != nil {
+			return nil, fmt.Errorf("route %s condition: %w", r.ID, err)
+		}
+	}
+	if cr.window, err = newActiveWindow(r.EffectiveFrom, r.ExpiresAt); err != nil {
+		return nil, fmt.Errorf("route %s: %w", r.ID, err)
+	}
+	return cr, nil
+}
+
+// resolveHandler looks up a named handler, or builds one redirecting to the destination
+// computed by an expression
+func resolveHandler(handler, destination string) (http.HandlerFunc, error) {
+	switch {
+	case len(destination) > 0 && len(handler) > 0:
+		return nil, errors.New("can't have both a handler and a destination")
+	case len(destination) > 0:
+		program, err := compileDestination(destination)
+		if err != nil {
+			return nil, fmt.Errorf("destination: %w", err)
+		}
+		return destinationHandler(destination, program), nil
+	default:
+		h, ok := handlers[handler]
+		if !ok {
+			return nil, fmt.Errorf("has unknown handler %q", handler)
+		}
+		return h, nil
+	}
+}
+
+// siteContext carries the matched site's resolved responses and redirects to its handlers
+type siteContext struct {
+	name      string
+	responses responses
+	hosts     map[string]responses
+	redirects map[string]string
+}
+
+func (sc *siteContext) wrap(ruleID string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, record := withRecord(req)
+		record.Site = sc.name
+		record.Rule = ruleID
+		record.site = sc
+
+		if !shadowing(req) {
+			now := time.Now().UTC()
+			client := clientFor(req)
+			traffic.record(sc.name, ruleID, client, now)
+			referrers.record(sc.name, ruleID, client, req, now)
+		}
+		h(w, req)
+	})
+}
+
+// responsesFor returns the landing page and gone message for the request's site, host
+// and language
+func responsesFor(req *http.Request) responses {
+	r := responses{LandingPage: landingPage, GoneMessage: apiResponse}
+	if sc := recordFor(req).site; sc != nil {
+		r = sc.responses
+		if hr, ok := sc.hosts[normaliseHost(req.Host)]; ok {
+			r = hr
+		}
+	}
+	return r.localise(languageFor(req))
+}
+
+// redirectsFor returns the article redirects for the request's site
+func redirectsFor(req *http.Request) map[string]string {
+	if sc := recordFor(req).site; sc != nil {
+		return sc.redirects
+	}
+	return visualRedirects
+}
+
+// aliasHosts rewrites requests for an aliased host to its canonical host, so
+// multiple domains can share one site's rules
+func aliasHosts(aliases map[string]string, h http.Handler) http.Handler {
+	if len(aliases) == 0 {
+		return h
+	}
+
+	normalised := make(map[string]string, len(aliases))
+	for alias, canonical := range aliases {
+		normalised[normaliseHost(alias)] = normaliseHost(canonical)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if canonical, ok := normalised[req.Host]; ok {
+			req.Host = canonical
+			if len(req.URL.Host) > 0 {
+				req.URL.Host = canonical
+			}
+		}
+		h.ServeHTTP(w, req)
+	})
+}
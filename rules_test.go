@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHostPatterns(t *testing.T) {
+	Convey("Given a list of host patterns", t, func() {
+		hp, err := compileHostPatterns([]string{
+			"neighbourhood.statistics.gov.uk",
+			"*.neighbourhood.statistics.gov.uk",
+			`~legacy[0-9]+\.ons\.gov\.uk`,
+			`~^ARCHIVE-[A-Z]+\.ONS\.GOV\.UK$`,
+		})
+		So(err, ShouldBeNil)
+
+		match := func(host string) bool {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = host
+			return hp.match(req, nil)
+		}
+
+		Convey("Then exact, wildcard and regex patterns match", func() {
+			So(match("neighbourhood.statistics.gov.uk"), ShouldBeTrue)
+			So(match("www2.neighbourhood.statistics.gov.uk"), ShouldBeTrue)
+			So(match("ness-1.neighbourhood.statistics.gov.uk"), ShouldBeTrue)
+			So(match("legacy42.ons.gov.uk"), ShouldBeTrue)
+		})
+
+		Convey("Then regex patterns match hosts whatever case they are written in", func() {
+			So(match("archive-abc.ons.gov.uk"), ShouldBeTrue)
+			So(match("Archive-ABC.ons.gov.uk"), ShouldBeTrue)
+			So(match("archive-1.ons.gov.uk"), ShouldBeFalse)
+		})
+
+		Convey("Then wildcards only match a single label", func() {
+			So(match("a.b.neighbourhood.statistics.gov.uk"), ShouldBeFalse)
+			So(match("neighbourhood.statistics.gov.uk.evil.com"), ShouldBeFalse)
+			So(match("legacy.ons.gov.uk"), ShouldBeFalse)
+		})
+	})
+
+	Convey("Invalid host patterns are rejected", t, func() {
+		_, err := compileHostPatterns([]string{"~("})
+		So(err, ShouldNotBeNil)
+		_, err = compileHostPatterns([]string{""})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRuleSet(t *testing.T) {
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	hc := healthcheck.New(versionInfo, time.Second*10, time.Minute)
+
+	Convey("Given a rule set with a host alias", t, func() {
+		rules := defaultRules()
+		rules.Aliases = map[string]string{"neighbourhood.ons.gov.uk": "neighbourhood.statistics.gov.uk"}
+		router, err := newTestRouter(hc, rules)
+		So(err, ShouldBeNil)
+
+		Convey("Then requests to the alias use the canonical host's rules", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "https://Neighbourhood.ONS.gov.uk/HTMLDocs/a", nil))
+			So(w.Code, ShouldEqual, redir)
+			So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/visualisations/nesscontent/a")
+		})
+	})
+
+	Convey("Given a rule set with per-site and per-host responses", t, func() {
+		rules := defaultRules()
+		rules.GoneMessage = "Gone."
+		for i := range rules.Sites {
+			if rules.Sites[i].Name == "wda" {
+				rules.Sites[i].LandingPage = "https://www.ons.gov.uk/help/wda"
+				rules.Sites[i].Hosts = append(rules.Sites[i].Hosts, "web2.ons.gov.uk")
+				rules.Sites[i].HostResponses = map[string]responses{
+					"web2.ons.gov.uk": {GoneMessage: "WDA is gone."},
+				}
+			}
+		}
+		So(rules.validate(), ShouldBeNil)
+		router, err := newTestRouter(hc, rules)
+		So(err, ShouldBeNil)
+
+		serve := func(url string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+			return w
+		}
+
+		Convey("Then each site uses its own landing page", func() {
+			So(serve("https://web.ons.gov.uk/ons/apiservice/web/a").Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/help/wda")
+			So(serve("https://other.ons.gov.uk/a").Header().Get("Location"), ShouldEqual, landingPage)
+		})
+
+		Convey("Then gone messages are inherited from the rule set unless a host overrides them", func() {
+			So(serve("https://neighbourhood.statistics.gov.uk/NDE2/a").Body.String(), ShouldEqual, "Gone.")
+			So(serve("https://web.ons.gov.uk/ons/api/a").Body.String(), ShouldEqual, "Gone.")
+			So(serve("https://web2.ons.gov.uk/ons/api/a").Body.String(), ShouldEqual, "WDA is gone.")
+			So(serve("https://web2.ons.gov.uk/ons/apiservice/web/").Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/help/wda")
+		})
+	})
+
+	Convey("Given a site with its own redirects", t, func() {
+		rules := defaultRules()
+		rules.Sites[3].Redirects = map[string]string{"new-article": "https://www.ons.gov.uk/new"}
+		So(rules.validate(), ShouldBeNil)
+		router, err := newTestRouter(hc, rules)
+		So(err, ShouldBeNil)
+
+		Convey("Then its articles are redirected instead of the built-in ones", func() {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "https://visual.ons.gov.uk/new-article/", nil))
+			So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/new")
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "https://visual.ons.gov.uk/baby-names", nil))
+			So(w.Header().Get("Location"), ShouldStartWith, visualArchivePrefix)
+		})
+
+		Convey("Then slugs must be single path segments with absolute destinations", func() {
+			rules.Sites[3].Redirects = map[string]string{"a/b": "https://www.ons.gov.uk/new"}
+			So(rules.validate(), ShouldNotBeNil)
+			rules.Sites[3].Redirects = map[string]string{"a": "/new"}
+			So(rules.validate(), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Landing pages must be absolute URLs", t, func() {
+		rules := defaultRules()
+		rules.Sites[0].LandingPage = "/help"
+		So(rules.validate(), ShouldNotBeNil)
+	})
+
+	Convey("Given a rules file", t, func() {
+		path := filepath.Join(t.TempDir(), "rules.json")
+
+		Convey("When it is valid", func() {
+			So(os.WriteFile(path, []byte(`{"version":"1","sites":[{"name":"x","hosts":["x.ons.gov.uk"],"routes":[{"id":"x","path":"/{uri:.*}","handler":"gone"}]}]}`), 0600), ShouldBeNil)
+			rules, err := loadRules(path)
+			So(err, ShouldBeNil)
+			So(rules.Version, ShouldEqual, "1")
+			So(rules.routeCount(), ShouldEqual, 1)
+		})
+
+		Convey("When it names an unknown handler", func() {
+			So(os.WriteFile(path, []byte(`{"sites":[{"name":"x","routes":[{"id":"x","path":"/","handler":"nope"}]}]}`), 0600), ShouldBeNil)
+			_, err := loadRules(path)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("When it has duplicate route ids", func() {
+			So(os.WriteFile(path, []byte(`{"sites":[{"name":"x","routes":[{"id":"x","path":"/","handler":"gone"},{"id":"x","path":"/a","handler":"gone"}]}]}`), 0600), ShouldBeNil)
+			_, err := loadRules(path)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("The default rules are valid", t, func() {
+		So(defaultRules().validate(), ShouldBeNil)
+	})
+}
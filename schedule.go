@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultExpiringDays is how far ahead the expiring rules report looks by default
+const defaultExpiringDays = 30
+
+// activeWindow matches requests made between a route's effective_from and expires_at
+// times. Either bound may be unset.
+type activeWindow struct {
+	from, until *time.Time
+}
+
+func newActiveWindow(from, until *time.Time) (*activeWindow, error) {
+	if from == nil && until == nil {
+		return nil, nil
+	}
+	if from != nil && until != nil && !until.After(*from) {
+		return nil, errors.New("expires_at must be after effective_from")
+	}
+	return &activeWindow{from: from, until: until}, nil
+}
+
+// match implements mux.MatcherFunc
+func (aw *activeWindow) match(_ *http.Request, _ *mux.RouteMatch) bool {
+	return aw.activeAt(time.Now())
+}
+
+func (aw *activeWindow) activeAt(t time.Time) bool {
+	if aw.from != nil && t.Before(*aw.from) {
+		return false
+	}
+	if aw.until != nil && !t.Before(*aw.until) {
+		return false
+	}
+	return true
+}
+
+// expiringRule is a route that stops applying within the report period
+type expiringRule struct {
+	Site          string     `json:"site"`
+	Rule          string     `json:"rule"`
+	Path          string     `json:"path"`
+	EffectiveFrom *time.Time `json:"effective_from,omitempty"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+}
+
+// expiring returns the routes in rs expiring after now and up to days later, soonest first
+func (rs *ruleSet) expiring(now time.Time, days int) []expiringRule {
+	until := now.AddDate(0, 0, days)
+	expiring := []expiringRule{}
+	for _, s := range rs.Sites {
+		for _, r := range s.Routes {
+			if r.ExpiresAt == nil || !r.ExpiresAt.After(now) || r.ExpiresAt.After(until) {
+				continue
+			}
+			expiring = append(expiring, expiringRule{
+				Site:          s.Name,
+				Rule:          r.ID,
+				Path:          r.Path,
+				EffectiveFrom: r.EffectiveFrom,
+				ExpiresAt:     *r.ExpiresAt,
+			})
+		}
+	}
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].ExpiresAt.Before(expiring[j].ExpiresAt)
+	})
+	return expiring
+}
+
+// expiringReportHandler reports the routes of the active rule set expiring in the next
+// ?days=N days
+func expiringReportHandler(rules *activeRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		days := defaultExpiringDays
+		if d := req.URL.Query().Get("days"); len(d) > 0 {
+			var err error
+			if days, err = strconv.Atoi(d); err != nil || days < 0 {
+				http.Error(w, "days must be a non-negative number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var rs *ruleSet
+		if rules != nil {
+			rs = rules.current()
+		}
+		if rs == nil {
+			http.Error(w, errNoRules.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		expiring := rs.expiring(time.Now().UTC(), days)
+
+		rows := make([][]string, 0, len(expiring))
+		for _, e := range expiring {
+			from := ""
+			if e.EffectiveFrom != nil {
+				from = e.EffectiveFrom.Format(time.RFC3339)
+			}
+			rows = append(rows, []string{e.Site, e.Rule, e.Path, from, e.ExpiresAt.Format(time.RFC3339)})
+		}
+		writeReport(w, req, expiring, []string{"site", "rule", "path", "effective_from", "expires_at"}, rows)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTimeBoundedRoutes(t *testing.T) {
+	Convey("Given routes with effective periods ahead of a fallback route", t, func() {
+		now := time.Now().UTC()
+		past, future := now.Add(-time.Hour), now.Add(time.Hour)
+		farFuture := now.AddDate(0, 0, 60)
+
+		rules := defaultRules()
+		rules.Sites[0].Routes = append([]route{
+			{ID: "ness-expired", Path: "/expired/{uri:.*}", Handler: "landing", ExpiresAt: &past},
+			{ID: "ness-expiring", Path: "/expiring/{uri:.*}", Handler: "landing", ExpiresAt: &future},
+			{ID: "ness-pending", Path: "/pending/{uri:.*}", Handler: "landing", EffectiveFrom: &future},
+			{ID: "ness-current", Path: "/current/{uri:.*}", Handler: "landing", EffectiveFrom: &past, ExpiresAt: &farFuture},
+			{ID: "ness-fallback", Path: "/{period:expired|expiring|pending|current}/{uri:.*}", Handler: "gone"},
+		}, rules.Sites[0].Routes...)
+		router, err := newTestRouter(healthcheck.HealthCheck{}, rules)
+		So(err, ShouldBeNil)
+
+		serve := func(path string) int {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "http://neighbourhood.statistics.gov.uk"+path, nil))
+			return w.Code
+		}
+
+		Convey("Then routes apply only within their effective period", func() {
+			So(serve("/expiring/a"), ShouldEqual, redir)
+			So(serve("/current/a"), ShouldEqual, redir)
+		})
+
+		Convey("Then the fallback route takes over outside it", func() {
+			So(serve("/expired/a"), ShouldEqual, http.StatusGone)
+			So(serve("/pending/a"), ShouldEqual, http.StatusGone)
+		})
+
+		Convey("Then routes expiring within the period are reported, soonest first", func() {
+			expiring := rules.expiring(now, 30)
+			So(expiring, ShouldHaveLength, 1)
+			So(expiring[0].Rule, ShouldEqual, "ness-expiring")
+
+			expiring = rules.expiring(now, 90)
+			So(expiring, ShouldHaveLength, 2)
+			So(expiring[1].Rule, ShouldEqual, "ness-current")
+			So(*expiring[1].EffectiveFrom, ShouldEqual, past)
+		})
+
+		Convey("Then the admin report lists them", func() {
+			active := newActiveRules("")
+			So(active.set(rules), ShouldBeNil)
+
+			w := httptest.NewRecorder()
+			getAdminRouter(nil, active).ServeHTTP(w, httptest.NewRequest("GET", "/reports/expiring?days=90&format=csv", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(rows, ShouldHaveLength, 3)
+			So(rows[1][1], ShouldEqual, "ness-expiring")
+
+			w = httptest.NewRecorder()
+			getAdminRouter(nil, active).ServeHTTP(w, httptest.NewRequest("GET", "/reports/expiring?days=soon", nil))
+			So(w.Code, ShouldEqual, http.StatusBadRequest)
+		})
+	})
+
+	Convey("Routes must expire after they take effect", t, func() {
+		now := time.Now()
+		rules := defaultRules()
+		rules.Sites[0].Routes[0].EffectiveFrom = &now
+		rules.Sites[0].Routes[0].ExpiresAt = &now
+		So(rules.validate(), ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shadowing reports whether req is a copy being served by the shadow rule set, whose
+// response is discarded. Handlers skip logging and usage counts for shadow requests.
+func shadowing(req *http.Request) bool {
+	return recordFor(req).shadow
+}
+
+// shadowResponse captures the status and headers written by the shadow rule set
+type shadowResponse struct {
+	header http.Header
+	status int
+}
+
+func (r *shadowResponse) Header() http.Header { return r.header }
+
+func (r *shadowResponse) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *shadowResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// shadowQueueSize is how many comparisons can wait for the shadow worker before more are
+// dropped
+const shadowQueueSize = 1024
+
+// shadowComparison is a request served by the active rule set, with what it did, waiting
+// to be compared with the shadow rule set
+type shadowComparison struct {
+	req      *http.Request
+	record   requestRecord
+	status   int
+	location string
+}
+
+// queueShadow queues a comparison of req with the shadow rule set for compareShadows,
+// dropping it if the queue is full so responses never wait for the shadow rules
+func (a *activeRules) queueShadow(req *http.Request, record *requestRecord, status int, location string) {
+	c := shadowComparison{req: req.Clone(context.WithoutCancel(req.Context())), record: *record, status: status, location: location}
+	select {
+	case a.comparisons <- c:
+	default:
+	}
+}
+
+// compareShadows makes the queued comparisons until ctx is cancelled
+func (a *activeRules) compareShadows(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-a.comparisons:
+			compareShadow(a.shadow, c)
+		}
+	}
+}
+
+// compareShadow serves a copy of a request with the shadow rule set and records whether
+// its status, Location or rule differ from what the active rule set did
+func compareShadow(shadow *activeRules, c shadowComparison) {
+	req, record, status, location := c.req, c.record, c.status, c.location
+	shadowRecord := &requestRecord{Client: record.Client, scheme: record.scheme, shadow: true}
+	shadowReq := req.WithContext(context.WithValue(req.Context(), recordKey{}, shadowRecord))
+	resp := &shadowResponse{header: http.Header{}}
+	shadow.ServeHTTP(resp, shadowReq)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+
+	var diffs []string
+	if resp.status != status {
+		diffs = append(diffs, "status")
+	}
+	if resp.header.Get("Location") != location {
+		diffs = append(diffs, "location")
+	}
+	if shadowRecord.Rule != record.Rule {
+		diffs = append(diffs, "rule")
+	}
+
+	shadowDiffs.record(shadowResult{
+		Site:              record.Site,
+		Rule:              record.Rule,
+		CandidateRule:     shadowRecord.Rule,
+		Difference:        strings.Join(diffs, "+"),
+		Status:            status,
+		CandidateStatus:   resp.status,
+		Location:          redaction.uri(location),
+		CandidateLocation: redaction.uri(resp.header.Get("Location")),
+		SamplePath:        redaction.uri(req.URL.RequestURI()),
+	}, time.Now().UTC())
+}
+
+type shadowResultKey struct {
+	site, rule, candidateRule, difference string
+	status, candidateStatus               int
+}
+
+// shadowResult counts the requests for which the active and shadow rule sets agreed, or
+// differed in the same way, with the most recent example
+type shadowResult struct {
+	Site              string `json:"site"`
+	Rule              string `json:"rule"`
+	CandidateRule     string `json:"candidate_rule"`
+	Difference        string `json:"difference,omitempty"`
+	Status            int    `json:"status"`
+	CandidateStatus   int    `json:"candidate_status"`
+	Location          string `json:"location,omitempty"`
+	CandidateLocation string `json:"candidate_location,omitempty"`
+	SamplePath        string `json:"sample_path"`
+	tally
+}
+
+// shadowStats compares the active and shadow rule sets per rule
+type shadowStats struct {
+	hitCounts[shadowResultKey, shadowResult, *shadowResult]
+}
+
+var shadowDiffs = newShadowStats()
+
+func newShadowStats() *shadowStats {
+	return &shadowStats{}
+}
+
+func (s *shadowStats) record(r shadowResult, at time.Time) {
+	key := shadowResultKey{r.Site, r.Rule, r.CandidateRule, r.Difference, r.Status, r.CandidateStatus}
+	s.count(key, at, func(shadowResultKey) *shadowResult {
+		return &shadowResult{Site: r.Site, Rule: r.Rule, CandidateRule: r.CandidateRule, Difference: r.Difference,
+			Status: r.Status, CandidateStatus: r.CandidateStatus}
+	}, func(result *shadowResult) {
+		result.Location = r.Location
+		result.CandidateLocation = r.CandidateLocation
+		result.SamplePath = r.SamplePath
+	})
+}
+
+// report returns the comparison results, or only the disagreements if diffOnly is set,
+// ordered by site and rule with the most hits first
+func (s *shadowStats) report(diffOnly bool) []shadowResult {
+	results := s.list(nil)
+	if diffOnly {
+		differ := results[:0]
+		for _, r := range results {
+			if len(r.Difference) > 0 {
+				differ = append(differ, r)
+			}
+		}
+		results = differ
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.Difference+"/"+a.CandidateRule < b.Difference+"/"+b.CandidateRule
+	})
+	return results
+}
+
+func shadowReportHandler(w http.ResponseWriter, req *http.Request) {
+	results := shadowDiffs.report(req.URL.Query().Get("diff") == "only")
+
+	rows := make([][]string, 0, len(results))
+	for _, r := range results {
+		rows = append(rows, []string{
+			r.Site,
+			r.Rule,
+			r.CandidateRule,
+			r.Difference,
+			strconv.Itoa(r.Status),
+			strconv.Itoa(r.CandidateStatus),
+			r.Location,
+			r.CandidateLocation,
+			r.SamplePath,
+			strconv.FormatInt(r.Hits, 10),
+			r.LastSeen.Format(time.RFC3339),
+		})
+	}
+	writeReport(w, req, results, []string{"site", "rule", "candidate_rule", "difference", "status", "candidate_status",
+		"location", "candidate_location", "sample_path", "hits", "last_seen"}, rows)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	"github.com/ONSdigital/log.go/v2/log"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestShadowRules(t *testing.T) {
+	Convey("Given active rules with a candidate rule set in shadow", t, func() {
+		shadowDiffs = newShadowStats()
+		traffic = newTrafficStats()
+		defer func() {
+			shadowDiffs = newShadowStats()
+			traffic = newTrafficStats()
+		}()
+
+		candidate := defaultRules()
+		candidate.Sites[0].Routes = append([]route{
+			{ID: "ness-area", Path: "/HTMLDocs/area/{code}", Destination: `"https://www.ons.gov.uk/explore-local-statistics/areas/" + vars.code`},
+			{ID: "ness-retired", Path: "/HTMLDocs/retired/{uri:.*}", Handler: "gone"},
+		}, candidate.Sites[0].Routes...)
+
+		active := newActiveRules("")
+		So(active.set(defaultRules()), ShouldBeNil)
+		active.shadow = newActiveRules("")
+		active.comparisons = make(chan shadowComparison, shadowQueueSize)
+		So(active.shadow.set(candidate), ShouldBeNil)
+		router := getRouter(&healthcheck.HealthCheck{}, active)
+
+		var logs bytes.Buffer
+		log.SetDestination(&logs, nil)
+		defer log.SetDestination(os.Stdout, os.Stderr)
+
+		// compare makes the queued comparisons, as compareShadows does in the background
+		compare := func() {
+			for len(active.comparisons) > 0 {
+				compareShadow(active.shadow, <-active.comparisons)
+			}
+		}
+		serve := func(path string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "http://neighbourhood.statistics.gov.uk"+path, nil))
+			compare()
+			return w
+		}
+
+		Convey("Then responses come from the active rules", func() {
+			w := serve("/HTMLDocs/area/E09000033")
+			So(w.Code, ShouldEqual, redir)
+			So(w.Header().Get("Location"), ShouldEqual, "https://www.ons.gov.uk/visualisations/nesscontent/area/E09000033")
+			So(serve("/HTMLDocs/retired/a").Code, ShouldEqual, redir)
+		})
+
+		Convey("Then differences are recorded by rule", func() {
+			serve("/HTMLDocs/area/E09000033")
+			serve("/HTMLDocs/area/W06000015")
+			serve("/HTMLDocs/retired/a")
+			serve("/HTMLDocs/other")
+
+			results := shadowDiffs.report(true)
+			So(results, ShouldHaveLength, 2)
+			So(results[0].Rule, ShouldEqual, "ness-website")
+			So(results[0].CandidateRule, ShouldEqual, "ness-area")
+			So(results[0].Difference, ShouldEqual, "location+rule")
+			So(results[0].Hits, ShouldEqual, 2)
+			So(results[0].CandidateLocation, ShouldEqual, "https://www.ons.gov.uk/explore-local-statistics/areas/W06000015")
+			So(results[1].Difference, ShouldEqual, "status+location+rule")
+			So(results[1].CandidateStatus, ShouldEqual, http.StatusGone)
+
+			all := shadowDiffs.report(false)
+			So(all, ShouldHaveLength, 3)
+			So(all[1].Difference, ShouldBeEmpty)
+			So(all[1].SamplePath, ShouldEqual, "/HTMLDocs/other")
+		})
+
+		Convey("Then comparisons are made after the response, and dropped when too many are waiting", func() {
+			active.comparisons = make(chan shadowComparison, 1)
+			for i := 0; i < 3; i++ {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("GET", "http://neighbourhood.statistics.gov.uk/HTMLDocs/retired/a", nil))
+				So(w.Code, ShouldEqual, redir)
+			}
+			So(shadowDiffs.report(false), ShouldBeEmpty)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				active.compareShadows(ctx)
+				close(done)
+			}()
+			for len(active.comparisons) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			cancel()
+			<-done
+			results := shadowDiffs.report(false)
+			So(results, ShouldHaveLength, 1)
+			So(results[0].Hits, ShouldEqual, 1)
+		})
+
+		Convey("Then the candidate doesn't log or count usage", func() {
+			serve("/HTMLDocs/retired/a")
+			So(bytes.Count(logs.Bytes(), []byte("returning api help text")), ShouldEqual, 0)
+			So(bytes.Count(logs.Bytes(), []byte("redirecting visualisation")), ShouldEqual, 1)
+			usage := traffic.report()
+			So(usage, ShouldHaveLength, 1)
+			So(usage[0].Rule, ShouldEqual, "ness-website")
+		})
+
+		Convey("Then the shadow report lists the disagreements as CSV", func() {
+			serve("/HTMLDocs/retired/a")
+			serve("/HTMLDocs/other")
+			w := httptest.NewRecorder()
+			getAdminRouter(nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/reports/shadow?format=csv&diff=only", nil))
+			So(w.Code, ShouldEqual, http.StatusOK)
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			So(err, ShouldBeNil)
+			So(rows, ShouldHaveLength, 2)
+			So(rows[1][2], ShouldEqual, "ness-retired")
+		})
+	})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	errUnsigned      = errors.New("rules aren't signed")
+	errBadSignature  = errors.New("rules signature is invalid")
+	errUnknownKey    = errors.New("rules are signed with an unknown key")
+	errNoSigningKeys = errors.New("signed rules are required but no public keys are configured")
+)
+
+// ruleBundle is a rule set with an ed25519 signature of its compacted JSON, made by the
+// sign command
+type ruleBundle struct {
+	Rules     json.RawMessage `json:"rules"`
+	KeyID     string          `json:"key_id"`
+	Signature []byte          `json:"signature"`
+}
+
+// signaturePolicy verifies signed rule bundles against public keys, and refuses unsigned
+// rules if signatures are required
+type signaturePolicy struct {
+	keys     map[string]ed25519.PublicKey
+	required bool
+}
+
+// ruleSigning is replaced in main with the policy from the service configuration. By
+// default unsigned rules are accepted.
+var ruleSigning = &signaturePolicy{}
+
+// newSignaturePolicy returns a policy verifying signatures with keys, which are base64
+// encoded ed25519 public keys
+func newSignaturePolicy(keys []string, required bool) (*signaturePolicy, error) {
+	p := &signaturePolicy{keys: make(map[string]ed25519.PublicKey, len(keys)), required: required}
+	for _, k := range keys {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k))
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid rules public key %q: must be a base64 encoded ed25519 public key", k)
+		}
+		pub := ed25519.PublicKey(b)
+		p.keys[keyID(pub)] = pub
+	}
+	if required && len(p.keys) == 0 {
+		return nil, errNoSigningKeys
+	}
+	return p, nil
+}
+
+// keyID identifies a public key in bundles by the start of its hash
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// decode parses rules, or a bundle of signed rules, and validates them. A bundle's
+// signature is verified if any keys are configured, and must be if signatures are
+// required.
+func (p *signaturePolicy) decode(b []byte) (*ruleSet, error) {
+	var bundle ruleBundle
+	if err := json.Unmarshal(b, &bundle); err != nil {
+		return nil, err
+	}
+
+	rules := b
+	switch {
+	case len(bundle.Rules) > 0:
+		if err := p.verify(bundle); err != nil {
+			return nil, err
+		}
+		rules = bundle.Rules
+	case p.required:
+		return nil, errUnsigned
+	}
+
+	var rs ruleSet
+	if err := json.Unmarshal(rules, &rs); err != nil {
+		return nil, err
+	}
+	if err := rs.validate(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// signedBundle returns b, compacted, if it is a bundle of signed rules, or nil if it isn't
+func signedBundle(b []byte) json.RawMessage {
+	var bundle ruleBundle
+	if err := json.Unmarshal(b, &bundle); err != nil || len(bundle.Rules) == 0 {
+		return nil
+	}
+	compacted, err := compactJSON(b)
+	if err != nil {
+		return nil
+	}
+	return compacted
+}
+
+func (p *signaturePolicy) verify(bundle ruleBundle) error {
+	if len(p.keys) == 0 && !p.required {
+		return nil
+	}
+	pub, ok := p.keys[bundle.KeyID]
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownKey, bundle.KeyID)
+	}
+	signed, err := compactJSON(bundle.Rules)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, signed, bundle.Signature) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// compactJSON removes insignificant white space, so a bundle's signature survives it
+// being reformatted
+func compactJSON(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// signRules returns a bundle of the rules in b signed with key
+func signRules(b []byte, key ed25519.PrivateKey) (*ruleBundle, error) {
+	var rs ruleSet
+	if err := json.Unmarshal(b, &rs); err != nil {
+		return nil, err
+	}
+	if err := rs.validate(); err != nil {
+		return nil, err
+	}
+
+	signed, err := compactJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleBundle{
+		Rules:     signed,
+		KeyID:     keyID(key.Public().(ed25519.PublicKey)),
+		Signature: ed25519.Sign(key, signed),
+	}, nil
+}
+
+// readSigningKey reads a PKCS #8 PEM encoded ed25519 private key, as written by
+// sign -generate or openssl genpkey -algorithm ed25519
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 private key", path)
+	}
+	return ed, nil
+}
+
+// writeSigningKey generates an ed25519 key, writes it to path and returns its public key
+func writeSigningKey(path string) (ed25519.PublicKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return pub, f.Close()
+}
+
+// signCommand writes a signed bundle of a rules file, or generates a signing key
+func signCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	keyFile := fs.String("key", "", "PEM encoded ed25519 private key")
+	generate := fs.Bool("generate", false, "generate a new key in -key and print its public key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(*keyFile) == 0 {
+		return flag.ErrHelp
+	}
+
+	if *generate {
+		if fs.NArg() != 0 {
+			return flag.ErrHelp
+		}
+		pub, err := writeSigningKey(*keyFile)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(pub))
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return flag.ErrHelp
+	}
+	key, err := readSigningKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	bundle, err := signRules(b, key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(bundle)
+}
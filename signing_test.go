@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSignedRules(t *testing.T) {
+	Convey("Given a rules file signed with a generated key", t, func() {
+		dir := t.TempDir()
+		keyFile, rulesFile := filepath.Join(dir, "key.pem"), filepath.Join(dir, "rules.json")
+		So(os.WriteFile(rulesFile, []byte(fmt.Sprintf(testRulesJSON, "v1")), 0o600), ShouldBeNil)
+
+		var pub, bundle bytes.Buffer
+		So(signCommand([]string{"-generate", "-key", keyFile}, &pub, &bytes.Buffer{}), ShouldBeNil)
+		So(signCommand([]string{"-key", keyFile, rulesFile}, &bundle, &bytes.Buffer{}), ShouldBeNil)
+		publicKey := strings.TrimSpace(pub.String())
+
+		previous := ruleSigning
+		defer func() { ruleSigning = previous }()
+		required, err := newSignaturePolicy([]string{publicKey}, true)
+		So(err, ShouldBeNil)
+
+		Convey("Then signed rules are loaded when signatures are required", func() {
+			rs, err := required.decode(bundle.Bytes())
+			So(err, ShouldBeNil)
+			So(rs.Version, ShouldEqual, "v1")
+		})
+
+		Convey("Then the signature survives the bundle being reformatted", func() {
+			var indented bytes.Buffer
+			So(json.Indent(&indented, bundle.Bytes(), "", "\t"), ShouldBeNil)
+			_, err := required.decode(indented.Bytes())
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Then tampered rules are refused", func() {
+			tampered := strings.Replace(bundle.String(), `"gone"`, `"landing"`, 1)
+			So(tampered, ShouldNotEqual, bundle.String())
+			_, err := required.decode([]byte(tampered))
+			So(err, ShouldEqual, errBadSignature)
+
+			Convey("Even when signatures aren't required", func() {
+				optional, err := newSignaturePolicy([]string{publicKey}, false)
+				So(err, ShouldBeNil)
+				_, err = optional.decode([]byte(tampered))
+				So(err, ShouldEqual, errBadSignature)
+			})
+		})
+
+		Convey("Then unsigned rules are refused when signatures are required", func() {
+			_, err := required.decode([]byte(fmt.Sprintf(testRulesJSON, "v1")))
+			So(err, ShouldEqual, errUnsigned)
+		})
+
+		Convey("Then rules signed with another key are refused", func() {
+			var other bytes.Buffer
+			So(signCommand([]string{"-generate", "-key", filepath.Join(dir, "other.pem")}, &other, &bytes.Buffer{}), ShouldBeNil)
+			policy, err := newSignaturePolicy([]string{strings.TrimSpace(other.String())}, true)
+			So(err, ShouldBeNil)
+			_, err = policy.decode(bundle.Bytes())
+			So(err, ShouldWrap, errUnknownKey)
+		})
+
+		Convey("When the service loads the bundle", func() {
+			ruleSigning = required
+			So(os.WriteFile(rulesFile, bundle.Bytes(), 0o600), ShouldBeNil)
+			rs, err := loadRules(rulesFile)
+
+			Convey("Then the signed rules are used", func() {
+				So(err, ShouldBeNil)
+				So(rs.Version, ShouldEqual, "v1")
+			})
+		})
+	})
+
+	Convey("Given signing configuration", t, func() {
+		Convey("Then signatures can't be required without public keys", func() {
+			_, err := newSignaturePolicy(nil, true)
+			So(err, ShouldEqual, errNoSigningKeys)
+		})
+
+		Convey("Then invalid public keys are refused", func() {
+			_, err := newSignaturePolicy([]string{base64.StdEncoding.EncodeToString([]byte("short"))}, false)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
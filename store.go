@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/log.go/v2/log"
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	errVersionNotFound = errors.New("rules version not found")
+	errNoAuthor        = errors.New("an author is required to change the rules")
+	errParentChanged   = errors.New("the rules have changed since the parent version")
+)
+
+var (
+	versionsBucket = []byte("versions")
+	auditBucket    = []byte("audit")
+	auditHeadKey   = []byte("head")
+)
+
+// ruleStore keeps every version of the rules in a bbolt database. Versions are numbered
+// from 1 and never change once written; a rollback writes the old rules as a new version.
+// Each version is audited once it is written, and removed again if it can't be.
+type ruleStore struct {
+	db *bolt.DB
+	mu sync.Mutex
+}
+
+// storedRules is a version of the rules with who wrote it, when and why. Rules and Bundle
+// are omitted when versions are listed.
+//
+// Bundle is the signed bundle the rules were pushed or seeded as, if they were signed.
+// Its signature is checked whenever the version is read, so signed rules can't be
+// changed in the database.
+type storedRules struct {
+	Version    uint64          `json:"version"`
+	Author     string          `json:"author"`
+	Message    string          `json:"message,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	RollbackOf uint64          `json:"rollback_of,omitempty"`
+	Rules      json.RawMessage `json:"rules,omitempty"`
+	Bundle     json.RawMessage `json:"bundle,omitempty"`
+}
+
+// openRuleStore opens or creates the store at path. The file is locked while open, so
+// only one process can use it at a time.
+func openRuleStore(path string) (*ruleStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(versionsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(auditBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ruleStore{db: db}, nil
+}
+
+func (s *ruleStore) Close() error {
+	return s.db.Close()
+}
+
+func versionKey(version uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, version)
+}
+
+// put validates rs and stores it as the next version, which becomes the current rules,
+// with the signed bundle it came from, if any. Nothing is stored if the version couldn't
+// then be loaded and served. The rule set's version is set to the
+// version number. If parent isn't 0 the rules are only stored if it is the current version.
+func (s *ruleStore) put(rs *ruleSet, bundle json.RawMessage, author, message string, parent uint64) (*storedRules, error) {
+	return s.write(rs, storedRules{Author: author, Message: message, Bundle: bundle}, parent, auditUpdate, "api")
+}
+
+// write validates rs and stores it as the next version like put, auditing it as action
+// from source
+func (s *ruleStore) write(rs *ruleSet, stored storedRules, parent uint64, action, source string) (*storedRules, error) {
+	if len(stored.Author) == 0 {
+		return nil, errNoAuthor
+	}
+	if err := rs.validate(); err != nil {
+		return nil, err
+	}
+
+	return s.appendAudited(func(b *bolt.Bucket) (*ruleSet, storedRules, error) {
+		if parent > 0 {
+			current, err := lastVersion(b)
+			if err != nil {
+				return nil, stored, err
+			}
+			if current == nil || current.Version != parent {
+				return nil, stored, fmt.Errorf("%w %d", errParentChanged, parent)
+			}
+		}
+		return rs, stored, nil
+	}, action, source)
+}
+
+// rollback stores the rules of version as a new version. The old version must be signed
+// if signed rules are required.
+func (s *ruleStore) rollback(version uint64, author string) (*storedRules, error) {
+	if len(author) == 0 {
+		return nil, errNoAuthor
+	}
+
+	return s.appendAudited(func(b *bolt.Bucket) (*ruleSet, storedRules, error) {
+		old, err := getVersion(b, version)
+		if err != nil {
+			return nil, storedRules{}, err
+		}
+		rs, err := old.ruleSet()
+		if err != nil {
+			return nil, storedRules{}, err
+		}
+		return rs, storedRules{
+			Author:     author,
+			Message:    fmt.Sprintf("rollback to version %d", version),
+			RollbackOf: version,
+			Bundle:     old.Bundle,
+		}, nil
+	}, auditRollback, "api")
+}
+
+// appendAudited appends the version next returns, in the transaction next reads the
+// versions in, and audits it with its changes from the version before once it is
+// committed. If it can't be audited the version is removed again, and otherwise the head
+// of the audit log is recorded so it can be checked by checkAudited.
+func (s *ruleStore) appendAudited(next func(b *bolt.Bucket) (*ruleSet, storedRules, error), action, source string) (*storedRules, error) {
+	// versions are written one at a time, so none is written on top of one that is
+	// removed as it couldn't be audited
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var written *storedRules
+	var rec auditRecord
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(versionsBucket)
+		rs, stored, err := next(b)
+		if err != nil {
+			return err
+		}
+		previous, err := lastVersion(b)
+		if err != nil {
+			return err
+		}
+		if written, err = appendVersion(b, rs, stored); err != nil {
+			return err
+		}
+		// the version is served as soon as it is committed, so it must load as it will
+		// be served: decoded from its bundle if signed, and compiled
+		served, err := written.ruleSet()
+		if err != nil {
+			return err
+		}
+		if _, err := served.handler(); err != nil {
+			return err
+		}
+
+		rec = auditRecord{Actor: written.Author, Action: action, Source: source, Version: strconv.FormatUint(written.Version, 10)}
+		if previous != nil {
+			var before, after ruleSet
+			if json.Unmarshal(previous.Rules, &before) == nil && json.Unmarshal(written.Rules, &after) == nil {
+				rec.Changes = diffRules(&before, &after)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := audit.append(rec)
+	if err != nil {
+		err = fmt.Errorf("rules not changed as the change couldn't be audited: %w", err)
+		if rmErr := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(versionsBucket).Delete(versionKey(written.Version))
+		}); rmErr != nil {
+			return nil, fmt.Errorf("%w, and version %d couldn't be removed: %v", err, written.Version, rmErr)
+		}
+		return nil, err
+	}
+	if head == nil {
+		return written, nil
+	}
+	// the change is made and audited, so failing to record the head only leaves the
+	// store checking for an older record
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(head)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(auditBucket).Put(auditHeadKey, v)
+	})
+	if err != nil {
+		log.Error(context.Background(), "failed to record the head of the audit log", err, log.Data{"version": written.Version})
+	}
+	return written, nil
+}
+
+// checkAudited checks that the audit log still has the last record the store wrote to it
+func (s *ruleStore) checkAudited(l *auditLog) error {
+	if l == nil {
+		return nil
+	}
+	var v []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v = append(v, tx.Bucket(auditBucket).Get(auditHeadKey)...)
+		return nil
+	})
+	if err != nil || v == nil {
+		return err
+	}
+	var head auditHead
+	if err := json.Unmarshal(v, &head); err != nil {
+		return fmt.Errorf("rule store's audit log head is corrupt: %w", err)
+	}
+	return l.contains(head)
+}
+
+func appendVersion(b *bolt.Bucket, rs *ruleSet, stored storedRules) (*storedRules, error) {
+	version, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	versioned := *rs
+	versioned.Version = strconv.FormatUint(version, 10)
+
+	stored.Version = version
+	stored.CreatedAt = time.Now().UTC()
+	if stored.Rules, err = json.Marshal(&versioned); err != nil {
+		return nil, err
+	}
+	v, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	return &stored, b.Put(versionKey(version), v)
+}
+
+func getVersion(b *bolt.Bucket, version uint64) (*storedRules, error) {
+	v := b.Get(versionKey(version))
+	if v == nil {
+		return nil, fmt.Errorf("%w: %d", errVersionNotFound, version)
+	}
+	var stored storedRules
+	if err := json.Unmarshal(v, &stored); err != nil {
+		return nil, fmt.Errorf("rules version %d is corrupt: %w", version, err)
+	}
+	return &stored, nil
+}
+
+// get returns a version of the rules
+func (s *ruleStore) get(version uint64) (*storedRules, error) {
+	var stored *storedRules
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = getVersion(tx.Bucket(versionsBucket), version)
+		return err
+	})
+	return stored, err
+}
+
+// current returns the latest version of the rules, or nil if the store is empty
+func (s *ruleStore) current() (*storedRules, error) {
+	var stored *storedRules
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = lastVersion(tx.Bucket(versionsBucket))
+		return err
+	})
+	return stored, err
+}
+
+// lastVersion returns the latest version in b, or nil if it is empty
+func lastVersion(b *bolt.Bucket) (*storedRules, error) {
+	k, _ := b.Cursor().Last()
+	if k == nil {
+		return nil, nil
+	}
+	return getVersion(b, binary.BigEndian.Uint64(k))
+}
+
+// list returns every version, newest first, without their rules
+func (s *ruleStore) list() ([]storedRules, error) {
+	var versions []storedRules
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(versionsBucket).ForEach(func(k, v []byte) error {
+			var stored storedRules
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("rules version %d is corrupt: %w", binary.BigEndian.Uint64(k), err)
+			}
+			stored.Rules, stored.Bundle = nil, nil
+			versions = append(versions, stored)
+			return nil
+		})
+	})
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, err
+}
+
+// ruleSet decodes and validates the stored rules. Signed versions are decoded from their
+// bundle, verifying its signature, and unsigned versions are refused if signed rules
+// are required.
+func (sr *storedRules) ruleSet() (*ruleSet, error) {
+	if len(sr.Bundle) > 0 || ruleSigning.required {
+		if len(sr.Bundle) == 0 {
+			return nil, fmt.Errorf("rules version %d: %w", sr.Version, errUnsigned)
+		}
+		rs, err := ruleSigning.decode(sr.Bundle)
+		if err != nil {
+			return nil, fmt.Errorf("rules version %d: %w", sr.Version, err)
+		}
+		rs.Version = strconv.FormatUint(sr.Version, 10)
+		return rs, nil
+	}
+
+	var rs ruleSet
+	if err := json.Unmarshal(sr.Rules, &rs); err != nil {
+		return nil, fmt.Errorf("rules version %d is corrupt: %w", sr.Version, err)
+	}
+	if err := rs.validate(); err != nil {
+		return nil, fmt.Errorf("rules version %d is invalid: %w", sr.Version, err)
+	}
+	return &rs, nil
+}
+
+// seedRuleStore stores the rules file at path, or the built-in rules if path is empty, as
+// the first version if the store is empty
+func seedRuleStore(store *ruleStore, path string) (*storedRules, error) {
+	if stored, err := store.current(); err != nil || stored != nil {
+		return nil, err
+	}
+
+	rules, author := defaultRules(), "builtin"
+	var bundle json.RawMessage
+	if len(path) > 0 {
+		var err error
+		if rules, bundle, err = readRules(path); err != nil {
+			return nil, err
+		}
+		author = path
+	}
+	return store.write(rules, storedRules{Author: author, Message: "initial rules", Bundle: bundle}, 0, auditSeed, "startup")
+}
+
+// storeError responds with the status for an error from the store
+func storeError(w http.ResponseWriter, req *http.Request, err error) {
+	switch {
+	case errors.Is(err, errVersionNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errParentChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errNoAuthor), errors.Is(err, errUnsigned), errors.Is(err, errBadSignature),
+		errors.Is(err, errUnknownKey), errors.As(err, new(*strconv.NumError)):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Error(req.Context(), "rules store request failed", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var versionsHeader = []string{"version", "author", "created_at", "message", "rollback_of"}
+
+func versionRow(sr storedRules) []string {
+	var rollbackOf string
+	if sr.RollbackOf > 0 {
+		rollbackOf = strconv.FormatUint(sr.RollbackOf, 10)
+	}
+	return []string{strconv.FormatUint(sr.Version, 10), sr.Author, sr.CreatedAt.Format(time.RFC3339), sr.Message, rollbackOf}
+}
+
+// rulesVersionsHandler lists the stored versions of the rules, newest first
+func rulesVersionsHandler(rules *activeRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		versions, err := rules.store.list()
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+
+		rows := make([][]string, 0, len(versions))
+		for _, v := range versions {
+			rows = append(rows, versionRow(v))
+		}
+		writeReport(w, req, versions, versionsHeader, rows)
+	}
+}
+
+// rulesVersionHandler responds with a stored version and its rules
+func rulesVersionHandler(rules *activeRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		version, err := strconv.ParseUint(mux.Vars(req)["version"], 10, 64)
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+		stored, err := rules.store.get(version)
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+		writeReport(w, req, stored, versionsHeader, [][]string{versionRow(*stored)})
+	}
+}
+
+// pushRulesHandler stores the rule set in the request body as a new version, by the holder
+// of the admin token and with the message given as a query parameter, and serves it. If
+// ?parent= is given the push is refused with a 409 unless it is the current version.
+func pushRulesHandler(rules *activeRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid rules: %s", err), http.StatusBadRequest)
+			return
+		}
+		rs, err := ruleSigning.decode(b)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid rules: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		query := req.URL.Query()
+		var parent uint64
+		if p := query.Get("parent"); len(p) > 0 {
+			if parent, err = strconv.ParseUint(p, 10, 64); err != nil {
+				storeError(w, req, err)
+				return
+			}
+		}
+		stored, err := rules.store.put(rs, signedBundle(b), adminName(req), query.Get("message"), parent)
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+		rules.stored(w, req, stored)
+	}
+}
+
+// rollbackRulesHandler stores the version given by ?to= as a new version and serves it
+func rollbackRulesHandler(rules *activeRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		version, err := strconv.ParseUint(query.Get("to"), 10, 64)
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+		stored, err := rules.store.rollback(version, adminName(req))
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+		rules.stored(w, req, stored)
+	}
+}
+
+// stored serves a version just written to the store and responds with the version
+func (a *activeRules) stored(w http.ResponseWriter, req *http.Request, stored *storedRules) {
+	log.Info(req.Context(), "rules changed", log.Data{"version": stored.Version, "author": stored.Author, "message": stored.Message})
+	if err := a.reload(req.Context()); err != nil {
+		storeError(w, req, err)
+		return
+	}
+
+	summary := *stored
+	summary.Rules, summary.Bundle = nil, nil
+	writeReport(w, req, summary, versionsHeader, [][]string{versionRow(summary)})
+}
+
+// rulesDiffHandler lists the differences between the versions given by ?from= and ?to=,
+// which defaults to the current version
+func rulesDiffHandler(rules *activeRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		load := func(param string) (*ruleSet, error) {
+			var stored *storedRules
+			var err error
+			if v := req.URL.Query().Get(param); len(v) > 0 || param == "from" {
+				var version uint64
+				if version, err = strconv.ParseUint(v, 10, 64); err != nil {
+					return nil, err
+				}
+				stored, err = rules.store.get(version)
+			} else if stored, err = rules.store.current(); err == nil && stored == nil {
+				err = errVersionNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+			return stored.ruleSet()
+		}
+
+		from, err := load("from")
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+		to, err := load("to")
+		if err != nil {
+			storeError(w, req, err)
+			return
+		}
+
+		changes := diffRules(from, to)
+		rows := make([][]string, 0, len(changes))
+		for _, c := range changes {
+			rows = append(rows, []string{c.Change, c.Path, c.Old, c.New})
+		}
+		writeReport(w, req, changes, []string{"change", "path", "old", "new"}, rows)
+	}
+}
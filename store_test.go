@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-healthcheck/healthcheck"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRuleStore(t *testing.T) {
+	Convey("Given an empty rule store", t, func() {
+		path := filepath.Join(t.TempDir(), "rules.db")
+		store, err := openRuleStore(path)
+		So(err, ShouldBeNil)
+		defer func() { store.Close() }()
+
+		current, err := store.current()
+		So(err, ShouldBeNil)
+		So(current, ShouldBeNil)
+
+		Convey("When it is seeded and changed", func() {
+			first, err := seedRuleStore(store, "")
+			So(err, ShouldBeNil)
+			So(first.Version, ShouldEqual, 1)
+			So(first.Author, ShouldEqual, "builtin")
+
+			rules := defaultRules()
+			rules.GoneMessage = "Gone."
+			second, err := store.put(rules, nil, "jo", "shorter gone message", 0)
+			So(err, ShouldBeNil)
+
+			Convey("Then versions increase and the latest is current", func() {
+				So(second.Version, ShouldEqual, 2)
+				current, err := store.current()
+				So(err, ShouldBeNil)
+				rs, err := current.ruleSet()
+				So(err, ShouldBeNil)
+				So(rs.Version, ShouldEqual, "2")
+				So(rs.GoneMessage, ShouldEqual, "Gone.")
+
+				again, err := seedRuleStore(store, "")
+				So(err, ShouldBeNil)
+				So(again, ShouldBeNil)
+			})
+
+			Convey("Then rolling back stores the old rules as a new version", func() {
+				third, err := store.rollback(1, "sam")
+				So(err, ShouldBeNil)
+				So(third.Version, ShouldEqual, 3)
+				So(third.RollbackOf, ShouldEqual, 1)
+				rs, err := third.ruleSet()
+				So(err, ShouldBeNil)
+				So(rs.GoneMessage, ShouldBeEmpty)
+
+				versions, err := store.list()
+				So(err, ShouldBeNil)
+				So(versions, ShouldHaveLength, 3)
+				So(versions[0].Version, ShouldEqual, 3)
+				So(versions[0].Author, ShouldEqual, "sam")
+				So(versions[0].Rules, ShouldBeNil)
+				So(versions[1].Message, ShouldEqual, "shorter gone message")
+			})
+
+			Convey("Then versions persist when the store is reopened", func() {
+				So(store.Close(), ShouldBeNil)
+				store, err = openRuleStore(path)
+				So(err, ShouldBeNil)
+				current, err := store.current()
+				So(err, ShouldBeNil)
+				So(current.Version, ShouldEqual, 2)
+			})
+
+			Convey("Then changes need an author, valid rules and a known version", func() {
+				_, err := store.put(rules, nil, "", "", 0)
+				So(err, ShouldEqual, errNoAuthor)
+				_, err = store.put(&ruleSet{}, nil, "jo", "", 0)
+				So(err, ShouldNotBeNil)
+				_, err = store.rollback(9, "jo")
+				So(err, ShouldWrap, errVersionNotFound)
+			})
+		})
+
+		Convey("When signed rules are required", func() {
+			keyFile, rulesFile := filepath.Join(t.TempDir(), "key.pem"), filepath.Join(t.TempDir(), "rules.json")
+			var pub, bundle bytes.Buffer
+			So(signCommand([]string{"-generate", "-key", keyFile}, &pub, &bytes.Buffer{}), ShouldBeNil)
+			So(os.WriteFile(rulesFile, []byte(fmt.Sprintf(testRulesJSON, "v1")), 0o600), ShouldBeNil)
+			So(signCommand([]string{"-key", keyFile, rulesFile}, &bundle, &bytes.Buffer{}), ShouldBeNil)
+			So(os.WriteFile(rulesFile, bundle.Bytes(), 0o600), ShouldBeNil)
+
+			unsigned, err := store.put(defaultRules(), nil, "jo", "before signing", 0)
+			So(err, ShouldBeNil)
+
+			previous := ruleSigning
+			defer func() { ruleSigning = previous }()
+			ruleSigning, err = newSignaturePolicy([]string{strings.TrimSpace(pub.String())}, true)
+			So(err, ShouldBeNil)
+
+			Convey("Then versions seeded from a bundle keep it and are verified when loaded", func() {
+				path := filepath.Join(t.TempDir(), "signed.db")
+				signed, err := openRuleStore(path)
+				So(err, ShouldBeNil)
+				defer signed.Close()
+				stored, err := seedRuleStore(signed, rulesFile)
+				So(err, ShouldBeNil)
+				So(stored.Bundle, ShouldNotBeEmpty)
+				rs, err := stored.ruleSet()
+				So(err, ShouldBeNil)
+				So(rs.Version, ShouldEqual, "1")
+
+				Convey("And rolling back to them keeps the bundle", func() {
+					rollback, err := signed.rollback(1, "sam")
+					So(err, ShouldBeNil)
+					So(rollback.Bundle, ShouldResemble, stored.Bundle)
+				})
+
+				Convey("And rules changed in the database are refused", func() {
+					stored.Bundle = json.RawMessage(strings.Replace(string(stored.Bundle), `"gone"`, `"landing"`, 1))
+					_, err := stored.ruleSet()
+					So(err, ShouldWrap, errBadSignature)
+				})
+			})
+
+			Convey("Then versions stored unsigned can't be loaded or rolled back to", func() {
+				_, err := unsigned.ruleSet()
+				So(err, ShouldWrap, errUnsigned)
+				_, err = store.rollback(unsigned.Version, "sam")
+				So(err, ShouldWrap, errUnsigned)
+				_, err = store.put(defaultRules(), nil, "jo", "after signing", 0)
+				So(err, ShouldWrap, errUnsigned)
+				current, err := store.current()
+				So(err, ShouldBeNil)
+				So(current.Version, ShouldEqual, unsigned.Version)
+			})
+		})
+	})
+}
+
+func TestRuleStoreAdmin(t *testing.T) {
+	versionInfo, _ := healthcheck.NewVersionInfo("", "", "")
+	hc := healthcheck.New(versionInfo, time.Second*10, time.Minute)
+
+	Convey("Given a redirector serving rules from a store", t, func() {
+		store, err := openRuleStore(filepath.Join(t.TempDir(), "rules.db"))
+		So(err, ShouldBeNil)
+		defer store.Close()
+		_, err = seedRuleStore(store, "")
+		So(err, ShouldBeNil)
+
+		active := newActiveRules("")
+		active.store = store
+		So(active.reload(context.Background()), ShouldBeNil)
+		router, admin := getRouter(&hc, active), getAdminRouter(adminTokens{"jo": "s3cret"}, active)
+
+		serve := func(h http.Handler, method, url, body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(method, url, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer s3cret")
+			h.ServeHTTP(w, req)
+			return w
+		}
+		pushed := fmt.Sprintf(testRulesJSON, "ignored")
+
+		Convey("When a rule set is pushed", func() {
+			w := serve(admin, "POST", "/rules/versions?message=retire+everything", pushed)
+			So(w.Code, ShouldEqual, http.StatusOK)
+
+			Convey("Then it is served immediately as the next version", func() {
+				So(w.Body.String(), ShouldContainSubstring, `"version": 2`)
+				So(serve(router, "GET", "https://web.ons.gov.uk/", "").Code, ShouldEqual, http.StatusGone)
+				So(active.status().Version, ShouldEqual, "2")
+			})
+
+			Convey("Then versions are listed with their authors", func() {
+				w := serve(admin, "GET", "/rules/versions?format=csv", "")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				lines := strings.Split(w.Body.String(), "\n")
+				So(lines[0], ShouldEqual, "version,author,created_at,message,rollback_of")
+				So(lines[1], ShouldStartWith, "2,jo,")
+				So(lines[1], ShouldEndWith, ",retire everything,")
+				So(lines[2], ShouldStartWith, "1,builtin,")
+			})
+
+			Convey("Then a version and its rules can be fetched", func() {
+				var stored storedRules
+				So(json.Unmarshal(serve(admin, "GET", "/rules/versions/2", "").Body.Bytes(), &stored), ShouldBeNil)
+				So(string(stored.Rules), ShouldContainSubstring, `"name": "x"`)
+				So(serve(admin, "GET", "/rules/versions/7", "").Code, ShouldEqual, http.StatusNotFound)
+			})
+
+			Convey("Then the versions can be diffed", func() {
+				var changes []ruleChange
+				So(json.Unmarshal(serve(admin, "GET", "/rules/diff?from=1", "").Body.Bytes(), &changes), ShouldBeNil)
+				So(changes, ShouldContain, ruleChange{Change: changeAdded, Path: "sites/x/routes/x", New: `{"id":"x","path":"/{uri:.*}","handler":"gone"}`})
+				So(changes, ShouldContain, ruleChange{Change: changeRemoved, Path: "sites/wda/route_order", Old: `["wda-website","wda-apiservice","wda-api"]`})
+			})
+
+			Convey("Then rolling back serves the old rules again", func() {
+				w := serve(admin, "POST", "/rules/rollback?to=1", "")
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldContainSubstring, `"rollback_of": 1`)
+				So(serve(router, "GET", "https://web.ons.gov.uk/", "").Code, ShouldEqual, redir)
+				So(active.status().Version, ShouldEqual, "3")
+			})
+
+			Convey("Then pushes based on an older version are refused", func() {
+				So(serve(admin, "POST", "/rules/versions?parent=1", pushed).Code, ShouldEqual, http.StatusConflict)
+				So(serve(admin, "POST", "/rules/versions?parent=x", pushed).Code, ShouldEqual, http.StatusBadRequest)
+				So(active.status().Version, ShouldEqual, "2")
+				So(serve(admin, "POST", "/rules/versions?parent=2", pushed).Code, ShouldEqual, http.StatusOK)
+				So(active.status().Version, ShouldEqual, "3")
+			})
+		})
+
+		Convey("Then invalid changes are rejected", func() {
+			So(serve(admin, "POST", "/rules/versions", `{"sites":[]}`).Code, ShouldEqual, http.StatusBadRequest)
+			So(serve(admin, "POST", "/rules/versions", `{`).Code, ShouldEqual, http.StatusBadRequest)
+			So(serve(admin, "POST", "/rules/rollback", "").Code, ShouldEqual, http.StatusBadRequest)
+			So(serve(admin, "POST", "/rules/rollback?to=9", "").Code, ShouldEqual, http.StatusNotFound)
+			So(active.status().Version, ShouldEqual, "1")
+		})
+
+		Convey("Then the rules can't be changed without an admin token", func() {
+			open := getAdminRouter(nil, active)
+			So(serve(open, "POST", "/rules/versions", pushed).Code, ShouldEqual, http.StatusUnauthorized)
+			So(serve(open, "POST", "/rules/rollback?to=1", "").Code, ShouldEqual, http.StatusUnauthorized)
+			So(serve(open, "GET", "/rules/versions", "").Code, ShouldEqual, http.StatusOK)
+			So(active.status().Version, ShouldEqual, "1")
+		})
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/log.go/v2/log"
+)
+
+// certReloader serves a TLS certificate and key from disk, reloading them when either
+// file changes so certificates can be rotated without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("both a certificate and key file are required")
+	}
+
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) reload() error {
+	modTime, err := c.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch reloads the certificate whenever the files change, checking every interval,
+// until ctx is cancelled. A failed reload leaves the previous certificate in use.
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := c.latestModTime()
+			c.mu.RLock()
+			unchanged := err == nil && modTime.Equal(c.modTime)
+			c.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+
+			if err := c.reload(); err != nil {
+				log.Error(ctx, "failed to reload TLS certificate", err, log.Data{"cert_file": c.certFile, "key_file": c.keyFile})
+				continue
+			}
+			log.Info(ctx, "reloaded TLS certificate", log.Data{"cert_file": c.certFile})
+		}
+	}
+}
+
+func (c *certReloader) certificate() *tls.Certificate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+// tlsConfig returns a server TLS config that always presents the current certificate,
+// including to clients that don't send SNI
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.certificate()},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// httpsUpgradeHandler redirects plain HTTP requests to the same URL on the HTTPS listener.
+// Only hosts named by the rules are redirected, so the listener can't be used to send users
+// to any host given in the request.
+func httpsUpgradeHandler(httpsAddr string, rules *activeRules) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	if port == "443" {
+		port = ""
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if len(port) > 0 {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		dest := "https://" + host + req.URL.RequestURI()
+		if !rules.servesHost(req.Host) {
+			rejectDestination(w, req, dest, errInvalidHost)
+			return
+		}
+		http.Redirect(w, req, dest, http.StatusPermanentRedirect)
+	})
+}
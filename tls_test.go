@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-legacy-redirector/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeSelfSignedCert writes a self-signed certificate and key for localhost with the given serial number
+func writeSelfSignedCert(certFile, keyFile string, serial int64, modTime time.Time) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func servedSerial(addr string) (int64, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func TestCertReloader(t *testing.T) {
+	Convey("Given a certificate and key on disk", t, func() {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		So(writeSelfSignedCert(certFile, keyFile, 1, time.Now().Add(-time.Minute)), ShouldBeNil)
+
+		certs, err := newCertReloader(certFile, keyFile)
+		So(err, ShouldBeNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go certs.watch(ctx, time.Millisecond*10)
+
+		serial := func() int64 {
+			cfg, err := certs.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+			So(err, ShouldBeNil)
+			leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+			So(err, ShouldBeNil)
+			return leaf.SerialNumber.Int64()
+		}
+		So(serial(), ShouldEqual, 1)
+
+		Convey("When the files are replaced", func() {
+			So(writeSelfSignedCert(certFile, keyFile, 2, time.Now()), ShouldBeNil)
+
+			Convey("Then the new certificate is served", func() {
+				So(waitFor(func() bool { return serial() == 2 }), ShouldBeTrue)
+			})
+		})
+
+		Convey("When the replacement is invalid", func() {
+			So(os.WriteFile(certFile, []byte("not a certificate"), 0600), ShouldBeNil)
+			time.Sleep(time.Millisecond * 50)
+
+			Convey("Then the previous certificate is still served", func() {
+				So(serial(), ShouldEqual, 1)
+			})
+		})
+	})
+
+	Convey("A certificate and key are both required", t, func() {
+		_, err := newCertReloader("cert.pem", "")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestHTTPSUpgrade(t *testing.T) {
+	rules := newActiveRules("")
+	if err := rules.reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Plain HTTP requests are redirected to HTTPS", t, func() {
+		w := httptest.NewRecorder()
+		httpsUpgradeHandler(":443", rules).ServeHTTP(w, httptest.NewRequest("GET", "http://web.ons.gov.uk/ons/api/a?b=c", nil))
+		So(w.Code, ShouldEqual, http.StatusPermanentRedirect)
+		So(w.Header().Get("Location"), ShouldEqual, "https://web.ons.gov.uk/ons/api/a?b=c")
+
+		w = httptest.NewRecorder()
+		httpsUpgradeHandler(":8443", rules).ServeHTTP(w, httptest.NewRequest("GET", "http://www2.neighbourhood.statistics.gov.uk/a", nil))
+		So(w.Header().Get("Location"), ShouldEqual, "https://www2.neighbourhood.statistics.gov.uk:8443/a")
+	})
+
+	Convey("Requests for hosts the rules don't name are rejected", t, func() {
+		w := httptest.NewRecorder()
+		httpsUpgradeHandler(":443", rules).ServeHTTP(w, httptest.NewRequest("GET", "http://evil.example/a", nil))
+		So(w.Code, ShouldEqual, http.StatusBadRequest)
+		So(w.Header().Get("Location"), ShouldBeEmpty)
+	})
+}
+
+func TestTLSServer(t *testing.T) {
+	defer draining.Store(false)
+
+	Convey("Given a server configured with a certificate", t, func() {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		So(writeSelfSignedCert(certFile, keyFile, 10, time.Now().Add(-time.Minute)), ShouldBeNil)
+
+		BuildTime = "0"
+		cfg, err := config.Get()
+		So(err, ShouldBeNil)
+		cfg.BindAddr = freeAddr()
+		cfg.HTTPBindAddr = freeAddr()
+		cfg.TLSCertFile = certFile
+		cfg.TLSKeyFile = keyFile
+		cfg.TLSReloadInterval = time.Millisecond * 10
+		cfg.DrainPeriod = 0
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- run(ctx, cfg) }()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		So(waitFor(func() bool { s, err := servedSerial(cfg.BindAddr); return err == nil && s == 10 }), ShouldBeTrue)
+
+		Convey("Then HTTPS requests are served", func() {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}}
+			resp, err := client.Get("https://" + cfg.BindAddr + "/ready")
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Then the HTTP listener redirects to HTTPS", func() {
+			client := &http.Client{
+				Transport:     &http.Transport{DisableKeepAlives: true},
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+			req, err := http.NewRequest("GET", "http://"+cfg.HTTPBindAddr+"/a", nil)
+			So(err, ShouldBeNil)
+			req.Host = "web.ons.gov.uk"
+			resp, err := client.Do(req)
+			So(err, ShouldBeNil)
+			resp.Body.Close()
+			So(resp.StatusCode, ShouldEqual, http.StatusPermanentRedirect)
+			_, port, _ := net.SplitHostPort(cfg.BindAddr)
+			So(resp.Header.Get("Location"), ShouldEqual, "https://web.ons.gov.uk:"+port+"/a")
+		})
+
+		Convey("Then a rotated certificate is served without a restart", func() {
+			So(writeSelfSignedCert(certFile, keyFile, 11, time.Now()), ShouldBeNil)
+			So(waitFor(func() bool { s, err := servedSerial(cfg.BindAddr); return err == nil && s == 11 }), ShouldBeTrue)
+		})
+	})
+}
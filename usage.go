@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tally is the number of requests counted under one key of a usage report, and when the
+// first and last of them were seen
+type tally struct {
+	Hits      int64     `json:"hits"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+func (t *tally) counted() *tally {
+	return t
+}
+
+// hitCounts counts requests per key for a usage report, in a usage type V that embeds a
+// tally. Once it holds max keys, if max isn't 0, requests with any other key are counted
+// under the key overflow returns for it, so callers sending random values can't use
+// unbounded memory.
+type hitCounts[K comparable, V any, P interface {
+	*V
+	counted() *tally
+}] struct {
+	mu       sync.Mutex
+	usage    map[K]P
+	max      int
+	overflow func(K) K
+}
+
+// count counts a request at time at under key, creating its usage with newUsage if it is
+// the first, and passes the usage to update, if given, while it is locked
+func (c *hitCounts[K, V, P]) count(key K, at time.Time, newUsage func(K) P, update func(P)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.usage == nil {
+		c.usage = map[K]P{}
+	}
+	usage, ok := c.usage[key]
+	if !ok {
+		if c.max > 0 && len(c.usage) >= c.max {
+			key = c.overflow(key)
+			usage, ok = c.usage[key]
+		}
+		if !ok {
+			usage = newUsage(key)
+			c.usage[key] = usage
+		}
+	}
+
+	t := usage.counted()
+	if t.Hits == 0 {
+		t.FirstSeen = at
+	}
+	t.Hits++
+	t.LastSeen = at
+	if update != nil {
+		update(usage)
+	}
+}
+
+// list returns a copy of the usage under every key, in no particular order. Usage with
+// maps or slices that are updated must be copied by clone, which is called while it is
+// locked.
+func (c *hitCounts[K, V, P]) list(clone func(V) V) []V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	usage := make([]V, 0, len(c.usage))
+	for _, u := range c.usage {
+		if clone != nil {
+			usage = append(usage, clone(*u))
+		} else {
+			usage = append(usage, *u)
+		}
+	}
+	return usage
+}